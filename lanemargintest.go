@@ -30,21 +30,19 @@ import (
 )
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"slices"
 	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
 
 	log "github.com/golang/glog"
-	structpb "google.golang.org/protobuf/types/known/structpb"
-	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
+	"local/ocpout"
 	ocppb "ocpdiag/results_go_proto"
 	lmtpb "lmt_go.proto"
 	pci "pciutils"
@@ -61,14 +59,30 @@ var lts []*linktest
 // lmts is the result proto
 var lmts *lmtpb.LinkMarginTest
 
+// runInfo is the metadata of the lmt run, recorded in the result.
+var runInfo *lmtpb.LinkMargin_RunInfo
+
+// SetRunInfo sets the run metadata to record in the result before MarginLinks.
+func SetRunInfo(version string, buildTime string, cmdline string) {
+	runInfo = &lmtpb.LinkMargin_RunInfo{
+		Version:     version,
+		BuildTime:   buildTime,
+		CommandLine: cmdline,
+	}
+}
+
 // A linktest has everything needed to test a link. It corresponds to a
 // LinkMargin proto message.
 type linktest struct {
 	usp, dsp  *port
 	pb        *lmtpb.LinkMargin
-	testReady bool                        // The link is capable of LMR testing.
-	allRx     [ReceiverEnumSize]*receiver // all Rx ordered by the receiver number. 0 & 7 are nil .
-	wg        *sync.WaitGroup             // Sometimes, links need to sync.
+	testReady bool                                       // The link is capable of LMR testing.
+	allRx     [ReceiverEnumSize]*receiver                // all Rx ordered by the receiver number. 0 & 7 are nil .
+	wg        *sync.WaitGroup                            // Sometimes, links need to sync.
+	run       *ocpout.Run                                // The OCP TestRun of the link's artifacts.
+	retimers  [maxRetimers]*lmtpb.LinkMargin_RetimerInfo // Detected retimers; nil if not present.
+	// stepPrefix prefixes the test_step_id of the receivers, e.g. "PRESET=P3;" of a sweep point.
+	stepPrefix string
 }
 
 // A port is a PCIe device that contains a bunch of lanes. It can be a USP or a DSP.
@@ -77,11 +91,17 @@ type port struct {
 	isUSP         bool
 	width         uint32
 	gen           uint32
-	pcieCapOffset int32 // PCI EXP CAPABILITIES offset
-	lmrAddr       int32 // LMR capability address
-	testReady     bool  // The port is capable of LMR testing.
-	hasd          bool  // saved Hardware Autonomous Speed Disable state
-	hawd          bool  // saved Hardware Autonomous Width Disable state
+	pcieCapOffset int32  // PCI EXP CAPABILITIES offset
+	lmrAddr       int32  // LMR capability address
+	aerAddr       int32  // AER capability address; 0 if not present
+	eqAddr        int32  // Physical Layer 16.0/32.0 GT/s capability address; 0 if not present
+	eqRate        uint32 // The data rate of the eqAddr capability in GT/s
+	testReady     bool   // The port is capable of LMR testing.
+	hasd          bool   // saved Hardware Autonomous Speed Disable state
+	hawd          bool   // saved Hardware Autonomous Width Disable state
+	tls           uint16 // saved Target Link Speed
+	maxGen        uint32 // Max Link Speed of the Link Capabilities
+	maxWidth      uint32 // Max Link Width of the Link Capabilities
 	speed         float64
 }
 
@@ -92,51 +112,52 @@ type receiver struct {
 	port      *port // Other than the USP, all retimer and usp receivers run from the DSP port.
 	parallel  bool  // whether to test all lanes in parallel
 	lanes     []*Lane
-	rxwg      *sync.WaitGroup // To sync the receiver port.
-	linkwg    *sync.WaitGroup // Sometimes, the receiver needs to wait for other links.
-	hwinfo    string          // OCP hardware_info_id
+	rxwg      *sync.WaitGroup               // To sync the receiver port.
+	linkwg    *sync.WaitGroup               // Sometimes, the receiver needs to wait for other links.
+	hwinfo    string                        // OCP hardware_info_id
+	step      *ocpout.Step                  // The OCP TestStep of margining the receiver.
+	quirk     *lmtpb.LinkMargin_Quirk       // The merged quirk applied to the receiver, or nil.
+	retimer   *lmtpb.LinkMargin_RetimerInfo // The retimer of a retimer receiver, or nil.
 }
 
 var (
-	// ocpPipe points to the ocp artifact streaming pipe shared by all lm go routines.
-	ocpPipe     *os.File
-	ocpPipeLock sync.Mutex
-	// seqNum is a shared monotonically increasing counter for determining if any artifact is lost.
-	seqNum atomic.Int32
-	// testRunStart is the OCP starting message
-	testRunStart *ocppb.TestRunStart
-	// testRunEnd tracks the OCP TestStatus and TestResult
-	testRunEnd *ocppb.TestRunEnd
+	// ocpRun streams the OCP artifacts of all lm go routines.
+	ocpRun *ocpout.Run
+	// ocpShared is set when the OCP TestRun is started and ended by the caller.
+	ocpShared bool
+	// ocpStepPrefix prefixes the test_step_id, to be unique in a shared TestRun.
+	ocpStepPrefix string
 )
 
 // OcpInit initializes the OCP output headers.
-func OcpInit(f *os.File, name string, version string, cmdline string, cfg *lmtpb.LinkMargin) {
-	ocpPipe = f
-	testRunStart = &ocppb.TestRunStart{
-		Name:        name,
-		Version:     version,
-		CommandLine: cmdline,
+func OcpInit(f io.WriteCloser, name string, version string, cmdline string, cfg *lmtpb.LinkMargin) {
+	ocpRun = ocpout.NewRun(f, name, version, cmdline)
+	if err := ocpRun.SetParameters(cfg); err != nil {
+		log.Exit(err)
 	}
-	// Initialize the OCP output artifact's sequence number. Default is 0.
-	seqNum.Store(int32(0)) // 0  because of the atomicity of the counter.Add(1)
-
-	opt := protojson.MarshalOptions{
-		UseProtoNames:   true,
-		UseEnumNumbers:  false,
-		EmitUnpopulated: false,
-		Multiline:       true,
-		Indent:          "  ",
-		AllowPartial:    false,
+}
+
+// OcpShare streams the OCP artifacts of MarginLinks into a TestRun started and ended by the
+// caller, e.g. a test sequence. The step IDs are prefixed, e.g. "SEQ=01;", to be unique in the run.
+func OcpShare(run *ocpout.Run, stepPrefix string) {
+	ocpRun = run
+	ocpShared = true
+	ocpStepPrefix = stepPrefix
+}
+
+// OcpDutInfo discovers the links of the spec, and composes their OCP DutInfo for a shared TestRun.
+func OcpDutInfo(cfg *lmtpb.LinkMargin) (*ocppb.DutInfo, error) {
+	pci.Init()
+	defer pci.Cleanup()
+
+	devs := pci.ScanDevices()
+	if !devs.Valid() {
+		return nil, fmt.Errorf("no pcie devices found")
 	}
-	if data, err := opt.Marshal(cfg); err != nil {
-		log.Exit(err)
-	} else {
-		var v structpb.Struct
-		if err := json.Unmarshal(data, &v); err != nil {
-			log.Exit(err)
-		}
-		testRunStart.Parameters = &v
+	if _, err := getLinks(devs, cfg); err != nil {
+		return nil, err
 	}
+	return ocpDutInfo(), nil
 }
 
 // /////////////////////////////////////////////////////////////////////////////////////////////////
@@ -189,15 +210,23 @@ func bdf2u32(bdf string) uint32 {
 
 // WriteResultPbtxt writes out the test results from the lts to a textproto.
 func WriteResultPbtxt(outfn string) error {
-	// Marshal test results into pbtxt bytes per lk.
-	lmts = new(lmtpb.LinkMarginTest)
+	lmts = Result()
+	return writeLmtsPbtxt(outfn)
+}
+
+// Result collects the test results from the lts, sorted by bus number.
+func Result() *lmtpb.LinkMarginTest {
 	lms := make([]*lmtpb.LinkMargin, 0, 8)
 	for _, lt := range lts {
 		lms = append(lms, lt.pb)
 	}
 	// Sorts the result pb message by bus number.
 	sort.SliceStable(lms, func(i, j int) bool { return bdf2u32(lms[i].GetUspBdf()) < bdf2u32(lms[j].GetUspBdf()) })
-	lmts.LinkMargin = lms
+	return &lmtpb.LinkMarginTest{LinkMargin: lms}
+}
+
+// writeLmtsPbtxt writes out the lmts result to a textproto.
+func writeLmtsPbtxt(outfn string) error {
 	opt := &prototext.MarshalOptions{
 		Multiline:    true,
 		Indent:       "  ",
@@ -228,6 +257,11 @@ func MarginLinks(cfg *lmtpb.LinkMargin) error {
 		return err
 	}
 
+	// The problems finding the links are streamed once the OCP TestRun starts.
+	if ocpRun == nil {
+		OcpInit(nil, "pcie_lmt", "undefined", fmt.Sprint(os.Args), cfg)
+	}
+
 	// Gets a list of links matching the test configuration.
 	lts, err := getLinks(devs, cfg)
 	if err != nil {
@@ -238,8 +272,20 @@ func MarginLinks(cfg *lmtpb.LinkMargin) error {
 		return err
 	}
 
+	// Tags the results with the host and the run, for merging results from many hosts.
+	if host, err := os.Hostname(); err == nil {
+		for _, lt := range lts {
+			lt.pb.Host = &host
+		}
+	}
+	for _, lt := range lts {
+		lt.pb.RunInfo = runInfo
+	}
+
 	// Starts OCP TestRun
-	ocpTestRunStart(cfg)
+	if !ocpShared {
+		ocpRun.Start(ocpDutInfo())
+	}
 
 	// Tests all links in parallel. Waits for all links to finish testing.
 	var wg sync.WaitGroup
@@ -249,83 +295,44 @@ func MarginLinks(cfg *lmtpb.LinkMargin) error {
 			wg.Add(1)
 			go func(lt *linktest) {
 				defer wg.Done()
-				lt.marginLink()
+				if lt.pb.WidthSteps != nil {
+					lt.stepWidths()
+				} else if lt.pb.SpeedSteps != nil {
+					lt.stepSpeeds()
+				} else if lt.pb.PresetSweep != nil {
+					lt.sweepPresets()
+				} else {
+					lt.marginLink()
+				}
 			}(lt)
 		}
 	}
 	wg.Wait()
 
 	// OCP TestRunEnd
-	testRunEnd.Status = ocppb.TestRunEnd_COMPLETE
-	testRunEnd.Result = ocppb.TestRunEnd_NOT_APPLICABLE
+	result := ocppb.TestRunEnd_NOT_APPLICABLE
 	for _, lt := range lts {
 		if lt.testReady {
 			for _, l := range lt.pb.ReceiverLanes {
 				if l.Pass != nil {
-					if *l.Pass && testRunEnd.Result != ocppb.TestRunEnd_FAIL {
-						testRunEnd.Result = ocppb.TestRunEnd_PASS
+					if *l.Pass && result != ocppb.TestRunEnd_FAIL {
+						result = ocppb.TestRunEnd_PASS
 					} else {
-						testRunEnd.Result = ocppb.TestRunEnd_FAIL
+						result = ocppb.TestRunEnd_FAIL
 					}
 				}
 			}
 		}
 	}
-	runArti := &ocppb.TestRunArtifact{
-		Artifact: &ocppb.TestRunArtifact_TestRunEnd{testRunEnd},
-	}
-	artiOut := &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestRunArtifact{runArti},
+	if !ocpShared {
+		ocpRun.End(ocppb.TestRunEnd_COMPLETE, result)
 	}
-	outputArtifact(artiOut)
-	ocpPipeLock.Lock()
-	ocpPipe.Close()
-	ocpPipeLock.Unlock()
 
 	return nil
 }
 
-// outputArtifact() streams artiOut to the OcpPipe.
-func outputArtifact(artiOut *ocppb.OutputArtifact) {
-	artiOut.SequenceNumber = int32(seqNum.Add(1))
-	artiOut.Timestamp = timestamppb.Now()
-	opt := &protojson.MarshalOptions{
-		UseProtoNames:   false,
-		UseEnumNumbers:  false,
-		EmitUnpopulated: false,
-		Multiline:       false,
-		Indent:          "",
-		AllowPartial:    false,
-	}
-	if data, err := opt.Marshal(artiOut); err != nil {
-		log.Errorf("pbj.Marshal(%v) failed: %v", data, err)
-	} else {
-		ocpPipeLock.Lock()
-		ocpPipe.Write(data)
-		ocpPipe.WriteString("\n")
-		ocpPipeLock.Unlock()
-	}
-}
-
-// ocpTestRunStart starts an OCP TestRun
-func ocpTestRunStart(cfg *lmtpb.LinkMargin) {
-	if testRunStart == nil {
-		if f, err := os.OpenFile("/dev/null", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777); err != nil {
-			log.Fatalf("error opening /dev/null : %v", err)
-		} else {
-			OcpInit(f, "pcie_lmt", "undefined", fmt.Sprint(os.Args), cfg)
-		}
-	}
-
-	ver := &ocppb.SchemaVersion{
-		Major: 2,
-		Minor: 0,
-	}
-	artiOut := &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_SchemaVersion{ver},
-	}
-	outputArtifact(artiOut)
-
+// ocpDutInfo composes the OCP DutInfo of the links.
+func ocpDutInfo() *ocppb.DutInfo {
 	dutInfo := &ocppb.DutInfo{
 		DutInfoId:     "this_pcie",
 		Name:          "pcie_lmt_dut_info",
@@ -335,61 +342,40 @@ func ocpTestRunStart(cfg *lmtpb.LinkMargin) {
 	var hwInfo *ocppb.HardwareInfo
 	for _, lt := range lts {
 		hwInfo = &ocppb.HardwareInfo{
-			HardwareInfoId: "BDF=" + lt.dsp.dev.BDFString() + ";RX=" + strings.TrimPrefix(lmtpb.LinkMargin_ReceiverEnum(1).String(), "R_"),
+			HardwareInfoId: rxHwInfoID(lt.dsp.dev, lmtpb.LinkMargin_R_DSP_A1),
 			Name:           "DSP",
 		}
 		dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
 
 		hwInfo = &ocppb.HardwareInfo{
-			HardwareInfoId: "BDF=" + lt.usp.dev.BDFString() + ";RX=" + strings.TrimPrefix(lmtpb.LinkMargin_ReceiverEnum(6).String(), "R_"),
+			HardwareInfoId: rxHwInfoID(lt.usp.dev, lmtpb.LinkMargin_R_USP_F6),
 			Name:           "USP",
 		}
 		dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
 
 		// Reads if retimer presents
-		addr := lt.dsp.pcieCapOffset + C.PCI_EXP_LNKSTA2
-		val := pci.ReadWord(lt.dsp.dev, addr)
-		retimer0 := (val & C.PCI_EXP_LINKSTA2_RETIMER) != 0
-		retimer1 := (val & C.PCI_EXP_LINKSTA2_2RETIMERS) != 0
-		if retimer0 {
-			hwInfo = &ocppb.HardwareInfo{
-				HardwareInfoId: "BDF=" + lt.dsp.dev.BDFString() + ";RX=" + strings.TrimPrefix(lmtpb.LinkMargin_ReceiverEnum(2).String(), "R_"),
-				Name:           "Retimer0-USP",
-			}
-			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
-			hwInfo = &ocppb.HardwareInfo{
-				HardwareInfoId: "BDF=" + lt.dsp.dev.BDFString() + ";RX=" + strings.TrimPrefix(lmtpb.LinkMargin_ReceiverEnum(3).String(), "R_"),
-				Name:           "Retimer0-DSP",
-			}
-			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
+		retimers := lt.retimersPresent()
+		if retimers[0] {
+			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos,
+				lt.retimerHwInfo(lmtpb.LinkMargin_R_RTU_B2, "Retimer0-USP"),
+				lt.retimerHwInfo(lmtpb.LinkMargin_R_RTD_C3, "Retimer0-DSP"))
 		}
-		if retimer1 {
-			hwInfo = &ocppb.HardwareInfo{
-				HardwareInfoId: "BDF=" + lt.dsp.dev.BDFString() + ";RX=" + strings.TrimPrefix(lmtpb.LinkMargin_ReceiverEnum(4).String(), "R_"),
-				Name:           "Retimer1-USP",
-			}
-			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
-			hwInfo = &ocppb.HardwareInfo{
-				HardwareInfoId: "BDF=" + lt.dsp.dev.BDFString() + ";RX=" + strings.TrimPrefix(lmtpb.LinkMargin_ReceiverEnum(5).String(), "R_"),
-				Name:           "Retimer1-DSP",
-			}
-			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
+		if retimers[1] {
+			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos,
+				lt.retimerHwInfo(lmtpb.LinkMargin_R_RTU_D4, "Retimer1-USP"),
+				lt.retimerHwInfo(lmtpb.LinkMargin_R_RTD_E5, "Retimer1-DSP"))
+		}
+		if !ocpLegacy {
+			dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, lt.laneHwInfos()...)
 		}
 	}
 
-	testRunStart.DutInfo = dutInfo
-	runArti := &ocppb.TestRunArtifact{
-		Artifact: &ocppb.TestRunArtifact_TestRunStart{testRunStart},
-	}
-	artiOut = &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestRunArtifact{runArti},
-	}
-	outputArtifact(artiOut)
+	return dutInfo
+}
 
-	testRunEnd = &ocppb.TestRunEnd{
-		Status: ocppb.TestRunEnd_UNKNOWN,
-		Result: ocppb.TestRunEnd_NOT_APPLICABLE,
-	}
+// rxHwInfoID composes the OCP hardware_info_id of a receiver accessed through the port device.
+func rxHwInfoID(dev pci.Dev, rec lmtpb.LinkMargin_ReceiverEnum) string {
+	return ocpout.ReceiverHwInfoID(dev.BDFString(), strings.TrimPrefix(rec.String(), "R_"))
 }
 
 // /////////////////////////////////////////////////////////////////////////////////////////////////
@@ -400,7 +386,6 @@ var linkwg sync.WaitGroup
 
 // getLinks gets a list of PCIe ports according to the proto param.
 func getLinks(devs pci.Dev, cfg *lmtpb.LinkMargin) ([]*linktest, error) {
-	var err error
 	const numLinks = 8 // estimated array-initial-size of links to be tested.
 	lts = make([]*linktest, 0, numLinks)
 	// Filters devices by Vid, Did, and/or Bus. Only downstream dev is selected.
@@ -427,84 +412,126 @@ func getLinks(devs pci.Dev, cfg *lmtpb.LinkMargin) ([]*linktest, error) {
 			}
 
 			log.V(2).Infoln("Found dev: ", dev.BDFString())
-			lt := new(linktest)
-			lt.usp = new(port)
-			lt.dsp = new(port)
-			lt.wg = &linkwg
-
-			// Then gets the link partner.
-			lt.usp.dev = dev
-			lt.dsp.dev, err = dev.FindDSP()
+			lt, err := newLinktest(dev, cfg, ocpRun)
 			if err != nil {
 				return nil, err
 			}
-
-			lt.dsp.isUSP = false
-			lt.usp.isUSP = true
-
-			// Clones a result protobuf for the test config protobuf.
-			lt.pb = proto.Clone(cfg).(*lmtpb.LinkMargin)
-			vendorID := uint32(d.VendorID)
-			lt.pb.VendorId = &vendorID
-			deviceID := uint32(d.DeviceID)
-			lt.pb.DeviceId = &deviceID
-			lt.pb.Bdf = ([]string{dev.BDFString()})
-			uspBdf := dev.BDFString()
-			lt.pb.UspBdf = &uspBdf
-			dspBdf := lt.dsp.dev.BDFString()
-			lt.pb.DspBdf = &dspBdf
 			lts = append(lts, lt)
+		}
+	}
+	return lts, nil
+}
 
-			// Gets port capability offsets.
-			var msg strings.Builder
-			lt.testReady = true
-			for _, p := range [2]*port{lt.dsp, lt.usp} {
-				p.testReady = true
-				bdf := p.dev.BDFString()
-				if p.pcieCapOffset, err = getPcieCapOffset(p.dev); err != nil {
-					p.testReady = false
-					lt.testReady = false
-					msg.WriteString(fmt.Sprintf("Error: %s: %s | ", bdf, err.Error()))
-				} else {
-					addr := p.pcieCapOffset + C.PCI_EXP_LNKSTA
-					val := pci.ReadWord(p.dev, addr)
-					p.width = uint32((val & C.PCI_EXP_LNKSTA_WIDTH) >> LinkStatusWidthPos)
-					p.gen = uint32(val & C.PCI_EXP_LNKSTA_SPEED)
-					msg.WriteString(fmt.Sprintf(
-						"Info: %s: PCIEXP CAP offset=%x; PCI_EXP_LNKSTA_WIDTH=%d; PCI_EXP_LNKSTA_SPEED=%d  | ",
-						bdf, p.pcieCapOffset, p.width, p.gen))
-					switch p.gen {
-					case Speed16G:
-						p.speed = 16.0e9
-					case Speed32G:
-						p.speed = 32.0e9
-					default:
-						log.V(1).Infoln(bdf, " speed %d is not gen4 nor gen5. Skipped.", p.gen)
-						p.speed = 0.0
-						p.testReady = false
-						lt.testReady = false
-					}
-				}
+// newLinktest reads the capabilities and the link status of the USP dev and its DSP, to test the
+// link by the cfg. The problems are streamed to the OCP run.
+func newLinktest(dev pci.Dev, cfg *lmtpb.LinkMargin, run *ocpout.Run) (*linktest, error) {
+	var err error
+	d := dev.GetDevInfo()
+	lt := new(linktest)
+	lt.usp = new(port)
+	lt.dsp = new(port)
+	lt.wg = &linkwg
+	lt.run = run
+
+	// Then gets the link partner.
+	lt.usp.dev = dev
+	lt.dsp.dev, err = dev.FindDSP()
+	if err != nil {
+		return nil, err
+	}
 
-				if p.lmrAddr, err = p.getLMRcapability(); err != nil {
-					p.testReady = false
-					// The LMR is required at gen4 and above. If it's not found, it's like not a real link.
-					lt.testReady = false
-					msg.WriteString(fmt.Sprintf("Error: %s: %s | ", bdf, err.Error()))
-				} else {
-					msg.WriteString(fmt.Sprintf("Info: %s: LMR CAP offset=%x | ", bdf, p.lmrAddr))
-				}
+	lt.dsp.isUSP = false
+	lt.usp.isUSP = true
+
+	// Clones a result protobuf for the test config protobuf.
+	lt.pb = proto.Clone(cfg).(*lmtpb.LinkMargin)
+	vendorID := uint32(d.VendorID)
+	lt.pb.VendorId = &vendorID
+	deviceID := uint32(d.DeviceID)
+	lt.pb.DeviceId = &deviceID
+	lt.pb.Bdf = ([]string{dev.BDFString()})
+	uspBdf := dev.BDFString()
+	lt.pb.UspBdf = &uspBdf
+	dspBdf := lt.dsp.dev.BDFString()
+	lt.pb.DspBdf = &dspBdf
+
+	// Gets port capability offsets.
+	var msg strings.Builder
+	lt.testReady = true
+	for _, p := range [2]*port{lt.dsp, lt.usp} {
+		p.testReady = true
+		bdf := p.dev.BDFString()
+		if p.pcieCapOffset, err = getPcieCapOffset(p.dev); err != nil {
+			p.testReady = false
+			lt.testReady = false
+			msg.WriteString("Error: " + ocpout.Errorf(run, ocpout.PortHwInfoID(bdf),
+				"pcie_lmt-pcie-cap-missing", "%v", err) + " | ")
+		} else {
+			addr := p.pcieCapOffset + C.PCI_EXP_LNKSTA
+			val := pci.ReadWord(p.dev, addr)
+			p.width = uint32((val & C.PCI_EXP_LNKSTA_WIDTH) >> LinkStatusWidthPos)
+			p.gen = uint32(val & C.PCI_EXP_LNKSTA_SPEED)
+			lnkcap := pci.ReadLong(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKCAP)
+			p.maxGen = uint32(lnkcap & C.PCI_EXP_LNKCAP_SPEED)
+			p.maxWidth = uint32((lnkcap & C.PCI_EXP_LNKCAP_WIDTH) >> lnkCapWidthPos)
+			msg.WriteString(fmt.Sprintf(
+				"Info: %s: PCIEXP CAP offset=%x; PCI_EXP_LNKSTA_WIDTH=%d; PCI_EXP_LNKSTA_SPEED=%d  | ",
+				bdf, p.pcieCapOffset, p.width, p.gen))
+			switch p.gen {
+			case Speed16G:
+				p.speed = 16.0e9
+			case Speed32G:
+				p.speed = 32.0e9
+			default:
+				ocpout.Infof(run, ocpout.PortHwInfoID(bdf), "Speed %d is not gen4 nor gen5. Skipped.", p.gen)
+				p.speed = 0.0
+				p.testReady = false
+				lt.testReady = false
+			}
+		}
+
+		if p.lmrAddr, err = p.getLMRcapability(); err != nil {
+			p.testReady = false
+			// The LMR is required at gen4 and above. If it's not found, it's like not a real link.
+			lt.testReady = false
+			msg.WriteString("Error: " + ocpout.Errorf(run, ocpout.PortHwInfoID(bdf),
+				"pcie_lmt-lmr-cap-missing", "%v", err) + " | ")
+		} else {
+			msg.WriteString(fmt.Sprintf("Info: %s: LMR CAP offset=%x | ", bdf, p.lmrAddr))
+		}
+
+		// AER is optional. Without it, only the link status is checked around margining.
+		if p.aerAddr, err = p.getExtCapability(C.PCI_EXT_CAP_ID_AER, "AER"); err != nil {
+			p.aerAddr = 0
+			msg.WriteString("Info: " + ocpout.Infof(run, ocpout.PortHwInfoID(bdf), "%v", err) + " | ")
+		}
+
+		// The equalization is optional too. Without it, the lanes have no equalization result.
+		if p.speed != 0 {
+			if p.eqAddr, p.eqRate, err = p.getEqCapability(); err != nil {
+				p.eqAddr = 0
+				msg.WriteString("Info: " + ocpout.Infof(run, ocpout.PortHwInfoID(bdf), "%v", err) + " | ")
 			}
-			message := msg.String()
-			lt.pb.Message = &message
 		}
 	}
-	return lts, nil
+	message := msg.String()
+	lt.pb.Message = &message
+
+	// Identifies the retimers, if any, through the DSP.
+	if lt.dsp.pcieCapOffset != 0 {
+		lt.identifyRetimers()
+	}
+	return lt, nil
 }
 
 // getLMRcapability scans the PCI capability linked list for LMR capability.
-// pciutils/ls-ecaps.c
 func (p *port) getLMRcapability() (int32, error) {
+	return p.getExtCapability(C.PCI_EXT_CAP_ID_LMR, "LMR")
+}
+
+// getExtCapability scans the PCI extended capability linked list for a capability ID.
+// pciutils/ls-ecaps.c
+func (p *port) getExtCapability(capID int32, name string) (int32, error) {
 	const (
 		ConfigSpace     = int32(0x1000)
 		CapabilityStart = int32(0x100)
@@ -515,7 +542,7 @@ func (p *port) getLMRcapability() (int32, error) {
 	var been [ConfigSpace]bool
 	for addr := CapabilityStart; addr != 0; {
 		hdr := int32(pci.ReadLong(p.dev, addr))
-		if (hdr & CapabilityMask) == C.PCI_EXT_CAP_ID_LMR {
+		if (hdr & CapabilityMask) == capID {
 			return addr, nil
 		}
 		been[addr] = true
@@ -524,7 +551,7 @@ func (p *port) getLMRcapability() (int32, error) {
 			return 0, fmt.Errorf("Capability chain loops at 0x%x", addr)
 		}
 	}
-	return 0, fmt.Errorf("LMR capability header not found")
+	return 0, fmt.Errorf("%s capability header not found", name)
 }
 
 // getPcieCapOffset scans the PCI capability linked list for PCIe CAP.
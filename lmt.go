@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -30,6 +31,7 @@ import (
 	log "github.com/golang/glog"
 	"google.golang.org/protobuf/encoding/protojson"
 	lmt "local/lanemargintest"
+	"local/ocpsink"
 )
 
 var (
@@ -50,11 +52,27 @@ var (
 	result   = flag.String("result", "result.pbtxt", "The result pbtxt file name.")
 	csv      = flag.String("csv", "", "Dumps a csv file for plotting.")
 	pb2csv   = flag.Bool("result2csv", false, "Converts the [result] to a [csv] file for plotting.")
-	ocpPipe  = flag.String("ocp_pipe", "/dev/null", "Named pipe or file to stream the OCP Artifacts.")
+	csvFmt   = flag.String("csv_format", "plot", "The [csv] format: plot, or tidy with one row per margin point.")
+	csvCols  = flag.String("csv_columns", "", "A comma-separated list of the tidy [csv] columns. Defaults to all: "+strings.Join(lmt.TidyCsvColumns(), ","))
+	sumCsv   = flag.String("summary_csv", "", "Dumps a tidy csv file with one row per lane.")
+	sumCols  = flag.String("summary_columns", "", "A comma-separated list of the [summary_csv] columns. Defaults to all: "+strings.Join(lmt.SummaryCsvColumns(), ","))
+	ascii    = flag.Bool("ascii_plot", false, "Draws each lane's eye scan in the terminal. Without a spec, draws the [result].")
+	merge    = flag.String("merge", "", "A comma-separated list of result files or globs to merge into the [result].")
+	stats    = flag.String("merge_stats", "", "Dumps the eye size population statistics of the -merge to a csv file.")
+	presets  = flag.String("preset_csv", "", "Dumps the preset sweep results as a preset-by-lane eye size matrix csv file.")
+	speeds   = flag.String("speed_csv", "", "Dumps the speed steps results as a gen-by-lane eye size matrix csv file.")
+	widths   = flag.String("width_csv", "", "Dumps the width steps results as a width-by-lane eye size matrix csv file.")
+	pq       = flag.String("parquet", "", "Dumps the result to [parquet].points.parquet and [parquet].lanes.parquet.")
+	metrics  = flag.String("metrics", "", "Dumps the result as Prometheus metrics to a .prom file for the textfile collector.")
+	report   = flag.String("report", "", "Renders an HTML eye plot report. Without a spec, renders the [result].")
+	ocp2res  = flag.String("ocp2result", "", "Rebuilds the [result] from an OCP artifact stream file, without testing.")
+	ocpFmt   = flag.String("ocp_format", "structured", "The OCP measurement format: structured, or legacy with the identity encoded in strings.")
+	ocpPipe  = flag.String("ocp_pipe", "/dev/null", "Named pipe or file to stream the OCP Artifacts; or -, unix://, tcp://, http(s):// or rotate:// sinks.")
+	ocpBuf   = flag.Int("ocp_buffer", 0, "Bytes of OCP Artifacts buffered for a slow ocp_pipe consumer before dropping. 0 writes synchronously, blocking on the consumer.")
 )
 
 func main() {
-	
+
 	flag.Parse()
 
 	if *getVer {
@@ -63,13 +81,95 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *csvFmt != "plot" && *csvFmt != "tidy" {
+		log.Exit("Error: -csv_format must be plot or tidy.")
+	}
+	// The columns are checked before the margining, not after it when the tables are written.
+	if err := lmt.CheckTidyCsvColumns(splitColumns(*csvCols)); err != nil {
+		log.Exit("Error: -csv_columns: ", err)
+	}
+	if err := lmt.CheckSummaryCsvColumns(splitColumns(*sumCols)); err != nil {
+		log.Exit("Error: -summary_columns: ", err)
+	}
+	if *ocpFmt != "structured" && *ocpFmt != "legacy" {
+		log.Exit("Error: -ocp_format must be structured or legacy.")
+	}
+	lmt.SetOcpLegacyFormat(*ocpFmt == "legacy")
+
 	if *pb2csv {
-		if *csv == "" || *result == "" {
-			log.Exit("Error: With -result2csv, both -result and -csv must be specified.")
+		if (*csv == "" && *sumCsv == "" && *pq == "" && *presets == "" && *speeds == "" && *widths == "") || *result == "" {
+			log.Exit("Error: With -result2csv, -result and -csv, -summary_csv, -parquet, -preset_csv, -speed_csv or -width_csv must be specified.")
 		}
 		lmt.ReadResult(*result)
-		lmt.ConvertToCsv(*csv)
+		writeTables()
+		if *report != "" {
+			lmt.WriteReport(*report)
+		}
+
+		os.Exit(0)
+	}
 
+	// Merges the results from many hosts into one, without testing.
+	if *merge != "" {
+		var resfns []string
+		for _, pattern := range strings.Split(*merge, ",") {
+			fns, err := filepath.Glob(pattern)
+			if err != nil {
+				log.Exit(err)
+			}
+			if len(fns) == 0 {
+				log.Exit("Error: -merge ", pattern, " matches no file.")
+			}
+			resfns = append(resfns, fns...)
+		}
+		if slices.Contains(resfns, *result) {
+			log.Exit("Error: -merge would overwrite the input ", *result, ". Use another -result.")
+		}
+		if err := lmt.MergeResults(resfns, *result); err != nil {
+			log.Exit(err)
+		}
+		if *stats != "" {
+			lmt.WritePopulationStats(*stats)
+		}
+		writeTables()
+		if *report != "" {
+			lmt.WriteReport(*report)
+		}
+		os.Exit(0)
+	}
+
+	// Rebuilds the result from an OCP artifact stream, e.g. when the test was killed.
+	if *ocp2res != "" {
+		if *ocp2res == *result {
+			log.Exit("Error: -ocp2result would overwrite the input ", *result, ". Use another -result.")
+		}
+		if err := lmt.ConvertOcpStream(*ocp2res, *result); err != nil {
+			log.Exit(err)
+		}
+		writeTables()
+		writeMetrics()
+		if *report != "" {
+			lmt.WriteReport(*report)
+		}
+		if *ascii {
+			lmt.PrintASCIIPlot(os.Stdout)
+		}
+		os.Exit(0)
+	}
+
+	// Renders an existing result without testing.
+	if (*report != "" || *ascii || *pq != "" || *metrics != "") && *spec == "" && *specJSON == "" {
+		lmt.ReadResult(*result)
+		writeMetrics()
+		if *pq != "" {
+			lmt.ConvertToParquet(*pq+".points.parquet", *pq+".lanes.parquet")
+		}
+		if *report != "" {
+			lmt.WriteReport(*report)
+		}
+		if *ascii {
+			lmt.PrintASCIIPlot(os.Stdout)
+		}
 		os.Exit(0)
 	}
 
@@ -117,7 +217,7 @@ func main() {
 				if bus, err := strconv.ParseUint(busstr, 0, 32); err != nil {
 					log.Error(busstr, " is not a valid bus number format.")
 				} else {
-					cfg.Bdf = append(cfg.GetBdf(), fmt.Sprintf("%04x:%02x:%02x.%d", 0, bus, 0, 0) )
+					cfg.Bdf = append(cfg.GetBdf(), fmt.Sprintf("%04x:%02x:%02x.%d", 0, bus, 0, 0))
 				}
 			}
 		}
@@ -162,12 +262,13 @@ func main() {
 	}
 
 	// If the file exists, it's assumed to be a named pipe to append in. Otherwise, it's a file to
-	// create and dump into.
-	if f, err := os.OpenFile(*ocpPipe, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777); err != nil {
+	// create and dump into. See ocpsink for the other sinks.
+	if f, err := ocpsink.Open(*ocpPipe, *ocpBuf); err != nil {
 		log.Fatalf("error opening the ocp_pipe: %s %v", *ocpPipe, err)
 	} else {
 		lmt.OcpInit(f, "pcie_lmt", version, fmt.Sprint(os.Args), cfg)
 	}
+	lmt.SetRunInfo(version, buildTime, fmt.Sprint(os.Args))
 
 	// Runs lane margin test.
 	t := time.Now()
@@ -181,7 +282,55 @@ func main() {
 	if err := lmt.WriteResultPbtxt(*result); err != nil {
 		log.Exit(err)
 	}
+	writeTables()
+	writeMetrics()
+	if *report != "" {
+		lmt.WriteReport(*report)
+	}
+	if *ascii {
+		lmt.PrintASCIIPlot(os.Stdout)
+	}
+}
+
+// writeMetrics dumps the result as Prometheus metrics if specified.
+func writeMetrics() {
+	if *metrics != "" {
+		if err := lmt.WriteMetricsFile(*metrics); err != nil {
+			log.Exit(err)
+		}
+	}
+}
+
+// writeTables converts the result to the csv and parquet files specified by the flags.
+func writeTables() {
 	if *csv != "" {
-		lmt.ConvertToCsv(*csv)
+		if *csvFmt == "tidy" {
+			lmt.ConvertToTidyCsv(*csv, splitColumns(*csvCols))
+		} else {
+			lmt.ConvertToCsv(*csv)
+		}
+	}
+	if *sumCsv != "" {
+		lmt.ConvertToSummaryCsv(*sumCsv, splitColumns(*sumCols))
+	}
+	if *pq != "" {
+		lmt.ConvertToParquet(*pq+".points.parquet", *pq+".lanes.parquet")
+	}
+	if *presets != "" {
+		lmt.ConvertToPresetCsv(*presets)
+	}
+	if *speeds != "" {
+		lmt.ConvertToSpeedCsv(*speeds)
+	}
+	if *widths != "" {
+		lmt.ConvertToWidthCsv(*widths)
+	}
+}
+
+// splitColumns splits a comma-separated column list. An empty list selects all columns.
+func splitColumns(cols string) []string {
+	if cols == "" {
+		return nil
 	}
+	return strings.Split(cols, ",")
 }
@@ -0,0 +1,155 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Draws the lanes' eye scans in a terminal, for bring-up over SSH.
+// The timing scan is drawn horizontally and the voltage scan vertically, crossing at the eye center:
+//
+//	                     M  0 +30 (+0.1157V)
+//	T -0.161UI E...M.....+....M....E +0.161UI
+//	           +...0..... ....0....5
+//	                     E 12 -20 (-0.0772V)
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	lmtpb "lmt_go.proto"
+)
+
+const asciiLegend = "Status: M=margining E=error out N=NAK S=setting up ?=unknown .=not tested; " +
+	"timing error counts: 0-9, +=more than 9\n"
+
+// PrintASCIIPlot draws the eye scan of every lane in the lmts result.
+func PrintASCIIPlot(w io.Writer) {
+	fmt.Fprint(w, asciiLegend)
+	for _, lm := range lmts.GetLinkMargin() {
+		for _, ln := range lm.GetReceiverLanes() {
+			writeASCIIEye(w, lm, ln)
+		}
+	}
+}
+
+// statusChar abbreviates the margin point status.
+func statusChar(mp *lmtpb.LinkMargin_Lane_MarginPoint) byte {
+	switch mp.GetStatus() {
+	case lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING:
+		return 'M'
+	case lmtpb.LinkMargin_Lane_MarginPoint_S_ERROR_OUT:
+		return 'E'
+	case lmtpb.LinkMargin_Lane_MarginPoint_S_NAK:
+		return 'N'
+	case lmtpb.LinkMargin_Lane_MarginPoint_S_SETTING_UP:
+		return 'S'
+	}
+	return '?'
+}
+
+// errorChar abbreviates the error count to a single character.
+func errorChar(mp *lmtpb.LinkMargin_Lane_MarginPoint) byte {
+	if mp.GetErrorCount() > 9 {
+		return '+'
+	}
+	return byte('0' + mp.GetErrorCount())
+}
+
+// signedSteps maps the margin points to their signed steps, where left and down are negative.
+// The points of non-independent directions apply to both sides.
+func signedSteps(points []*lmtpb.LinkMargin_Lane_MarginPoint) map[int]*lmtpb.LinkMargin_Lane_MarginPoint {
+	m := make(map[int]*lmtpb.LinkMargin_Lane_MarginPoint)
+	for _, mp := range points {
+		s := int(mp.GetSteps())
+		switch mp.GetDirection() {
+		case lmtpb.LinkMargin_Lane_MarginPoint_D_LEFT, lmtpb.LinkMargin_Lane_MarginPoint_D_DOWN:
+			m[-s] = mp
+		case lmtpb.LinkMargin_Lane_MarginPoint_D_LR, lmtpb.LinkMargin_Lane_MarginPoint_D_UD:
+			m[-s] = mp
+			m[s] = mp
+		default:
+			m[s] = mp
+		}
+	}
+	return m
+}
+
+// writeASCIIEye draws a lane's timing and voltage scans crossing at the eye center.
+func writeASCIIEye(w io.Writer, lm *lmtpb.LinkMargin, ln *lmtpb.LinkMargin_Lane) {
+	result := "FAIL"
+	if ln.GetPass() {
+		result = "PASS"
+	}
+	fmt.Fprintf(w, "\n%s %s Lane %d: %s", lm.GetUspBdf(), ln.GetReceiver().String(), ln.GetLaneNumber(),
+		result)
+	if ln.EyeWidth != nil {
+		fmt.Fprintf(w, ", eye width %.4fUI", ln.GetEyeWidth())
+	}
+	if ln.EyeHeight != nil {
+		fmt.Fprintf(w, ", eye height %.4fV", ln.GetEyeHeight())
+	}
+	fmt.Fprintln(w)
+
+	tpts := signedSteps(ln.GetTimingMargins())
+	vpts := signedSteps(ln.GetVoltageMargins())
+	n := 0
+	for s := range tpts {
+		n = max(n, s, -s)
+	}
+	param := ln.GetLaneParameter()
+	var uiPerStep, voltPerStep float32
+	if param.GetNumTimingSteps() != 0 {
+		uiPerStep = float32(param.GetMaxTimingOffset()) / float32(param.GetNumTimingSteps()*100)
+	}
+	if param.GetNumVoltageSteps() != 0 {
+		voltPerStep = float32(param.GetMaxVoltageOffset()) / float32(param.GetNumVoltageSteps()*100)
+	}
+	prefix := ""
+	if len(tpts) != 0 {
+		prefix = fmt.Sprintf("T %+.3fUI ", -float32(n)*uiPerStep)
+	}
+	center := strings.Repeat(" ", len(prefix)+n)
+
+	// Voltage scan, from top to bottom, with the timing scan drawn at the center.
+	vsteps := make([]int, 0, len(vpts)+1)
+	for s := range vpts {
+		if s != 0 {
+			vsteps = append(vsteps, s)
+		}
+	}
+	vsteps = append(vsteps, 0)
+	slices.Sort(vsteps)
+	slices.Reverse(vsteps)
+	for _, s := range vsteps {
+		if s != 0 {
+			mp := vpts[s]
+			fmt.Fprintf(w, "%s%c %2d %+d (%+.4fV)\n", center, statusChar(mp), mp.GetErrorCount(), s,
+				float32(s)*voltPerStep)
+			continue
+		}
+		if len(tpts) == 0 {
+			fmt.Fprintf(w, "%s+\n", center)
+			continue
+		}
+		status := []byte(strings.Repeat(".", 2*n+1))
+		errs := []byte(strings.Repeat(".", 2*n+1))
+		status[n], errs[n] = '+', ' '
+		for s, mp := range tpts {
+			status[s+n], errs[s+n] = statusChar(mp), errorChar(mp)
+		}
+		fmt.Fprintf(w, "%s%s %+.3fUI\n", prefix, status, float32(n)*uiPerStep)
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", len(prefix)), errs)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// BER confidence statistics for the target-BER driven test spec.
+// Bit errors are modeled as a Poisson process: with N bits checked at a BER, the expected error
+// count is lambda = N * BER. The confidence of BER <= target, after seeing k errors in N bits, is
+// the probability of seeing more than k errors if the BER were exactly the target.
+
+import (
+	"math"
+
+	log "github.com/golang/glog"
+	"local/ocpout"
+)
+
+const (
+	// defaultConfidence is used when target_ber is specified without a confidence.
+	defaultConfidence = 0.95
+	// maxErrorLimit is the 6-bit Error Count Limit of the Set Error Count Limit command.
+	maxErrorLimit = 63
+	// maxSampleCount is the 7-bit Sample Count: 3*log2(bits).
+	maxSampleCount = 127
+)
+
+// poissonCDF returns P(X <= k) for a Poisson distribution with mean lambda.
+func poissonCDF(k uint32, lambda float64) float64 {
+	if lambda <= 0 {
+		return 1.0
+	}
+	sum := 0.0
+	for i := uint32(0); i <= k; i++ {
+		lg, _ := math.Lgamma(float64(i) + 1)
+		sum += math.Exp(-lambda + float64(i)*math.Log(lambda) - lg)
+	}
+	return math.Min(sum, 1.0)
+}
+
+// requiredBits returns the number of bits to check, so that seeing no more than errLimit errors
+// claims BER <= ber at the confidence level. For errLimit == 0, it is -ln(1 - confidence) / ber.
+func requiredBits(ber float64, confidence float64, errLimit uint32) float64 {
+	// Finds lambda where P(X <= errLimit) == 1 - confidence. The CDF decreases as lambda grows.
+	alpha := 1.0 - confidence
+	lo, hi := 0.0, float64(errLimit)+1.0
+	for poissonCDF(errLimit, hi) > alpha {
+		hi *= 2
+	}
+	for i := 0; i < 100 && hi-lo > 1e-9*hi; i++ {
+		mid := (lo + hi) / 2
+		if poissonCDF(errLimit, mid) > alpha {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi / ber
+}
+
+// berConfidence returns the confidence of BER <= ber after seeing errCount errors in bits.
+func berConfidence(bits float64, errCount uint32, ber float64) float64 {
+	return 1.0 - poissonCDF(errCount, bits*ber)
+}
+
+// applyTargetBer derives the bit count, samples and error limit of an aspect from its target_ber
+// and confidence. A target_ber not within (0, 1) is dropped, falling back to the samples. Without
+// an error_limit, the largest one whose required bits fit in the max sample count is used, so a
+// single bit error doesn't fail the point.
+func (ln *Lane) applyTargetBer(t *aspect) {
+	ber := t.spec.GetTargetBer()
+	if !(ber > 0 && ber < 1) {
+		ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: target_ber %E is not within (0, 1), using samples %d",
+			ln.laneNumber, ber, t.spec.GetSamples())
+		t.spec.TargetBer = nil
+		t.bitCount = math.Pow(2.0, float64(t.spec.GetSamples())/3.0)
+		return
+	}
+	confidence := float64(t.spec.GetConfidence())
+	if t.spec.Confidence == nil || confidence <= 0 || confidence >= 1 {
+		if t.spec.Confidence != nil {
+			ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: confidence %f is not within (0, 1), using %f",
+				ln.laneNumber, confidence, defaultConfidence)
+		}
+		confidence = defaultConfidence
+		c := float32(confidence)
+		t.spec.Confidence = &c
+	}
+	if t.spec.ErrorLimit == nil {
+		errLimit := deriveErrorLimit(ber, confidence)
+		t.spec.ErrorLimit = &errLimit
+	} else if t.spec.GetErrorLimit() > maxErrorLimit {
+		ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: error_limit %d exceeds %d, adjusting",
+			ln.laneNumber, t.spec.GetErrorLimit(), maxErrorLimit)
+		errLimit := uint32(maxErrorLimit)
+		t.spec.ErrorLimit = &errLimit
+	}
+
+	t.bitCount = requiredBits(ber, confidence, t.spec.GetErrorLimit())
+	samples := uint32(math.Ceil(math.Log2(t.bitCount) * 3))
+	if samples > maxSampleCount {
+		ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: %.3E bits required for BER %.2E at %.1f%% exceeds the max sample count",
+			ln.laneNumber, t.bitCount, ber, confidence*100)
+		samples = maxSampleCount
+		t.bitCount = math.Pow(2.0, float64(samples)/3.0)
+	}
+	t.spec.Samples = samples
+
+	log.V(1).Infof("Lane %d: target BER %.2E at %.1f%% confidence with error_limit %d requires %.3E bits",
+		ln.laneNumber, ber, confidence*100, t.spec.GetErrorLimit(), t.bitCount)
+}
+
+// deriveErrorLimit returns the largest error limit, up to maxErrorLimit, whose required bits
+// for BER <= ber at the confidence level fit in the max sample count. It is 0 if none fits.
+func deriveErrorLimit(ber float64, confidence float64) uint32 {
+	maxBits := math.Pow(2.0, maxSampleCount/3.0)
+	errLimit := uint32(0)
+	for errLimit < maxErrorLimit && requiredBits(ber, confidence, errLimit+1) <= maxBits {
+		errLimit++
+	}
+	return errLimit
+}
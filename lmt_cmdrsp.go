@@ -123,11 +123,13 @@ func (cr *cmdRsp) decode(raw uint16) {
 func (ln *Lane) lmrCmdRspBase(cmd *cmdRsp, matchPayload bool) (*cmdRsp, error) {
 	dev := ln.dev
 	addr := ln.addr
+	// Some receivers need more time between commands than the spec minimum.
+	wait := CmdWait + time.Duration(ln.rx.quirk.GetExtraCmdDelayUs())*time.Microsecond
 	pci.WriteWord(dev, addr, cmd.encode())
 	t := time.Now()
 	var rsp cmdRsp
-	for do := true; do; do = time.Since(t) < CmdTimeout {
-		time.Sleep(CmdWait)
+	for do := true; do; do = time.Since(t) < CmdTimeout+wait {
+		time.Sleep(wait)
 		// The response is the next word (byte-address plus 2).
 		rsp.decode(uint16(pci.ReadWord(dev, addr+2)))
 		if rsp.rec == cmd.rec && rsp.typ == cmd.typ && rsp.usage == 0 &&
@@ -0,0 +1,86 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Equalization capture. The Physical Layer 16.0 GT/s and 32.0 GT/s extended capabilities hold
+// the equalization status of the link, and the transmitter presets per lane.
+
+/*
+// The Cgo import here is only for using pciutils constants.
+#include "lib/header.h"
+*/
+import (
+	"C"
+)
+
+import (
+	"fmt"
+
+	lmtpb "lmt_go.proto"
+	pci "pciutils"
+)
+
+// The registers common to the Physical Layer 16.0 GT/s and 32.0 GT/s capabilities.
+const (
+	eqStaComplete = 0x01 // Equalization Complete
+	eqStaPhase1   = 0x02 // Equalization Phase 1 Successful
+	eqStaPhase2   = 0x04 // Equalization Phase 2 Successful
+	eqStaPhase3   = 0x08 // Equalization Phase 3 Successful
+	eqStaRequest  = 0x10 // Link Equalization Request
+	eqLaneCtl     = 0x20 // Lane Equalization Control, one byte per lane.
+	eqDspPreset   = 0x0F // Downstream Port Transmitter Preset of the lane
+	eqUspPreset   = 0xF0 // Upstream Port Transmitter Preset of the lane
+	eqUspPos      = 4
+)
+
+// getEqCapability locates the Physical Layer capability of the port's link speed, which holds
+// the equalization of that speed. It returns the data rate of the capability in GT/s.
+func (p *port) getEqCapability() (int32, uint32, error) {
+	switch p.gen {
+	case Speed16G:
+		addr, err := p.getExtCapability(C.PCI_EXT_CAP_ID_16GT, "Physical Layer 16.0 GT/s")
+		return addr, 16, err
+	case Speed32G:
+		addr, err := p.getExtCapability(C.PCI_EXT_CAP_ID_32GT, "Physical Layer 32.0 GT/s")
+		return addr, 32, err
+	}
+	return 0, 0, fmt.Errorf("no equalization capability at gen%d", p.gen)
+}
+
+// readEqualization reads the configured transmitter presets and the equalization status of the
+// lane, or nil if the port has no Physical Layer capability of the link speed.
+func (p *port) readEqualization(lane int) *lmtpb.LinkMargin_Equalization {
+	if p.eqAddr == 0 {
+		return nil
+	}
+	var sta uint32
+	if p.eqRate == 16 {
+		sta = pci.ReadLong(p.dev, p.eqAddr+C.PCI_16GT_STA)
+	} else {
+		sta = pci.ReadLong(p.dev, p.eqAddr+C.PCI_32GT_STA)
+	}
+	ctl := pci.ReadByte(p.dev, p.eqAddr+eqLaneCtl+int32(lane))
+	return &lmtpb.LinkMargin_Equalization{
+		RateGts:          p.eqRate,
+		PortBdf:          p.dev.BDFString(),
+		DspTxPreset:      uint32(ctl & eqDspPreset),
+		UspTxPreset:      uint32(ctl&eqUspPreset) >> eqUspPos,
+		Complete:         sta&eqStaComplete != 0,
+		Phase1Successful: sta&eqStaPhase1 != 0,
+		Phase2Successful: sta&eqStaPhase2 != 0,
+		Phase3Successful: sta&eqStaPhase3 != 0,
+		Request:          sta&eqStaRequest != 0,
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Link health checks around margining a receiver, using the AER and the PCIe status registers.
+
+/*
+// The Cgo import here is only for using pciutils constants.
+#include "lib/header.h"
+*/
+import (
+	"C"
+)
+
+import (
+	"fmt"
+
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	"local/ocpout"
+	ocppb "ocpdiag/results_go_proto"
+	pci "pciutils"
+)
+
+const (
+	// devStaErrors are the RW1C error detected bits of the Device Status.
+	devStaErrors = C.PCI_EXP_DEVSTA_CED | C.PCI_EXP_DEVSTA_NFED | C.PCI_EXP_DEVSTA_FED |
+		C.PCI_EXP_DEVSTA_URD
+	// lnkStaRecovery are the RW1C Link Status bits set when the link retrains or changes
+	// bandwidth, i.e., the LTSSM went through Recovery. Only implemented by a DSP.
+	lnkStaRecovery = C.PCI_EXP_LNKSTA_BWMGMT | C.PCI_EXP_LNKSTA_AUTBW
+)
+
+// linkHealth is a snapshot of the error and link status registers of a port.
+type linkHealth struct {
+	devsta uint16 // Device Status
+	lnksta uint16 // Link Status
+	cor    uint32 // AER Correctable Error Status; 0 without AER.
+	uncor  uint32 // AER Uncorrectable Error Status; 0 without AER.
+}
+
+// readHealth takes a health snapshot of the port.
+func (p *port) readHealth() linkHealth {
+	var h linkHealth
+	h.devsta = pci.ReadWord(p.dev, p.pcieCapOffset+C.PCI_EXP_DEVSTA)
+	h.lnksta = pci.ReadWord(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKSTA)
+	if p.aerAddr != 0 {
+		h.cor = pci.ReadLong(p.dev, p.aerAddr+C.PCI_ERR_COR_STATUS)
+		h.uncor = pci.ReadLong(p.dev, p.aerAddr+C.PCI_ERR_UNCOR_STATUS)
+	}
+	return h
+}
+
+// clearHealth clears the newly set status bits by writing 1s back. Bits set before margining
+// are left alone, as they are not caused by the test.
+func (p *port) clearHealth(pre, post linkHealth) {
+	if v := post.devsta &^ pre.devsta & devStaErrors; v != 0 {
+		pci.WriteWord(p.dev, p.pcieCapOffset+C.PCI_EXP_DEVSTA, v)
+	}
+	if v := post.lnksta &^ pre.lnksta & lnkStaRecovery; v != 0 {
+		pci.WriteWord(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKSTA, v)
+	}
+	if p.aerAddr == 0 {
+		return
+	}
+	if v := post.cor &^ pre.cor; v != 0 {
+		pci.WriteLong(p.dev, p.aerAddr+C.PCI_ERR_COR_STATUS, v)
+	}
+	if v := post.uncor &^ pre.uncor; v != 0 {
+		pci.WriteLong(p.dev, p.aerAddr+C.PCI_ERR_UNCOR_STATUS, v)
+	}
+}
+
+// readLinkHealth takes health snapshots of the DSP and the USP, in that order.
+func (lt *linktest) readLinkHealth() [2]linkHealth {
+	return [2]linkHealth{lt.dsp.readHealth(), lt.usp.readHealth()}
+}
+
+// checkLinkHealth compares the snapshots before and after margining a receiver, and reports
+// the new errors as OCP measurements. It returns false if the link is no longer usable, i.e.,
+// an uncorrectable error, or the DSP reports the link down or training.
+func (lt *linktest) checkLinkHealth(r *receiver, pre [2]linkHealth) bool {
+	post := lt.readLinkHealth()
+	healthy := true
+	for i, p := range [2]*port{lt.dsp, lt.usp} {
+		bdf := p.dev.BDFString()
+		newCor := post[i].cor &^ pre[i].cor
+		newUncor := post[i].uncor &^ pre[i].uncor
+		newDevsta := post[i].devsta &^ pre[i].devsta & devStaErrors
+		var errs string
+		if p.aerAddr != 0 {
+			outputHealthMeasurement(r, fmt.Sprintf("aer-cor-%s", bdf), "AER Correctable Error Check",
+				newCor, 0)
+			outputHealthMeasurement(r, fmt.Sprintf("aer-uncor-%s", bdf),
+				"AER Uncorrectable Error Check", newUncor, 0)
+			if newCor != 0 {
+				errs += fmt.Sprintf("AER cor=0x%x; ", newCor)
+			}
+			if newUncor != 0 {
+				errs += fmt.Sprintf("AER uncor=0x%x; ", newUncor)
+				healthy = false
+			}
+		}
+		outputHealthMeasurement(r, fmt.Sprintf("devsta-%s", bdf), "Device Error Detected Check",
+			uint32(newDevsta), 0)
+		if newDevsta != 0 {
+			errs += fmt.Sprintf("DEVSTA=0x%x; ", newDevsta)
+		}
+
+		// Link Status of a USP reflects the DSP, except the DSP-only fields.
+		if !p.isUSP {
+			newRecovery := post[i].lnksta &^ pre[i].lnksta & lnkStaRecovery
+			training := (post[i].lnksta & C.PCI_EXP_LNKSTA_TRAIN) != 0
+			outputHealthMeasurement(r, fmt.Sprintf("recovery-%s", bdf), "Link Recovery Check",
+				uint32(newRecovery), 0)
+			outputHealthMeasurement(r, fmt.Sprintf("training-%s", bdf), "Link Training Check",
+				boolToUint32(training), 0)
+			if newRecovery != 0 {
+				errs += fmt.Sprintf("LNKSTA recovery=0x%x; ", newRecovery)
+			}
+			if training {
+				errs += "Link training; "
+				healthy = false
+			}
+			lnkcap := pci.ReadLong(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKCAP)
+			if (lnkcap & C.PCI_EXP_LNKCAP_DLLA) != 0 {
+				active := (post[i].lnksta & C.PCI_EXP_LNKSTA_DL_ACT) != 0
+				outputHealthMeasurement(r, fmt.Sprintf("dl-active-%s", bdf), "DL Active Check",
+					boolToUint32(active), 1)
+				if !active {
+					errs += "DL inactive; "
+					healthy = false
+				}
+			}
+		}
+
+		if errs != "" {
+			message := ocpout.Logf(r.step, ocppb.Log_ERROR, r.hwinfo, "Post margin at %s: %s", bdf, errs)
+			fullMessage := lt.pb.GetMessage() + message + "| "
+			lt.pb.Message = &fullMessage
+		}
+		if lt.pb.GetClearAer() {
+			p.clearHealth(pre[i], post[i])
+		}
+	}
+	return healthy
+}
+
+// outputHealthMeasurement streams a health check measurement of the receiver validated to equal the
+// expected.
+func outputHealthMeasurement(r *receiver, name string, check string, val uint32, expected uint32) {
+	validator := &ocppb.Validator{
+		Name:  check,
+		Type:  ocppb.Validator_EQUAL,
+		Value: structpb.NewNumberValue(float64(expected)),
+	}
+	m := &ocppb.Measurement{
+		Name:           name,
+		Value:          structpb.NewNumberValue(float64(val)),
+		HardwareInfoId: r.hwinfo,
+		Validators:     []*ocppb.Validator{validator},
+	}
+	r.step.Measurement(m)
+}
+
+// boolToUint32 converts a status bit to a measurement value.
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
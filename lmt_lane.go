@@ -26,6 +26,7 @@ import (
 	log "github.com/golang/glog"
 	structpb "google.golang.org/protobuf/types/known/structpb"
 	pbj "google.golang.org/protobuf/encoding/protojson"
+	"local/ocpout"
 	ocppb "ocpdiag/results_go_proto"
 	lmtpb "lmt_go.proto"
 	pci "pciutils"
@@ -43,6 +44,13 @@ const (
 	neg        // 1
 )
 
+// The eye corners, in the info of the corner margin points, e.g. "EYE CORNER MAX-PASSING RIGHT",
+// and in the OCP measurement names.
+const (
+	cornerMaxPassing = "MAX-PASSING"
+	cornerMinFailing = "MIN-FAILING"
+)
+
 // /////////////////////////////////////////////////////////////////////////////////////////////////
 
 // A Lane conducts a series of timing/voltage margining points
@@ -67,11 +75,12 @@ type Lane struct {
 	linkwg    *sync.WaitGroup // Wait for all links.
 	eyeWidth  float32
 	eyeHeight float32
+	eq        *lmtpb.LinkMargin_Equalization // The equalization before margining, or nil.
+	// The eye width/height was measured, by the eye size or the eye scan mode.
+	hasEyeWidth, hasEyeHeight bool
 	// OCP JSON message output
-	stepArtiOut *ocppb.OutputArtifact
-	mStepArti   *ocppb.TestStepArtifact
-	statusVal   *ocppb.Validator
-	berVal      *ocppb.Validator
+	statusVal *ocppb.Validator
+	berVal    *ocppb.Validator
 }
 
 // Init initialized a new Lane instance with the test setup.
@@ -102,16 +111,6 @@ func (ln *Lane) Init(
 	ln.tsteps = nil
 	ln.vsteps = nil
 	ln.rx = rx
-
-	// OCP JSON message output
-	ln.mStepArti = &ocppb.TestStepArtifact{
-		Artifact:   &ocppb.TestStepArtifact_Measurement{Measurement: nil},
-		TestStepId: ln.rx.hwinfo,
-	}
-
-	ln.stepArtiOut = &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: ln.mStepArti},
-	}
 }
 
 const (
@@ -152,9 +151,13 @@ func (ln *Lane) MarginLane() error {
 		ln.msg = msg.String()
 	}()
 
+	if ln.rx.quirk != nil {
+		msg.WriteString(quirkString(ln.rx.quirk) + " | ")
+	}
+
 	// Reads Lane parameters
 	if err := ln.readLaneParameters(); err != nil {
-		log.Errorf("Failed to read lane parameters for lane %d: %v", ln.laneNumber, err)
+		ln.laneError(&msg, "pcie_lmt-lane-param-read-error", fmt.Errorf("failed to read lane parameters: %w", err))
 		ln.rxwg.Done()
 		return err
 	}
@@ -170,7 +173,7 @@ func (ln *Lane) MarginLane() error {
 	for i := range aspects {
 		if err := ln.testAspect(&aspects[i], &msg); err != nil {
 			// Log error and continue to next test type if desired, or return error to stop all tests.
-			log.Errorf("Error executing test for lane %d: %v", ln.laneNumber, err)
+			ln.laneError(&msg, "pcie_lmt-lane-test-error", err)
 			return err
 		}
 	}
@@ -181,6 +184,12 @@ func (ln *Lane) MarginLane() error {
 	return nil
 }
 
+// laneError appends a tool-side error of the lane to msg, and streams it as an OCP Error.
+func (ln *Lane) laneError(msg *strings.Builder, symptom string, err error) {
+	ocpout.Errorf(ln.rx.step, ln.ocpHwInfo(), symptom, "Lane %d: %v", ln.laneNumber, err)
+	msg.WriteString(err.Error() + " | ")
+}
+
 // readLaneParameters() reads the Lane margining capability parameters from each
 // Lane.
 func (ln *Lane) readLaneParameters() error {
@@ -249,6 +258,16 @@ func (ln *Lane) readLaneParameters() error {
 		param.MaxVoltageOffset = defaultMaxVoltageOffset
 	}
 
+	// Some devices report bogus offsets. The quirk overrides them.
+	if q := ln.rx.quirk; q != nil {
+		if q.MaxTimingOffset != nil {
+			param.MaxTimingOffset = q.GetMaxTimingOffset()
+		}
+		if q.MaxVoltageOffset != nil {
+			param.MaxVoltageOffset = q.GetMaxVoltageOffset()
+		}
+	}
+
 	cmd.payload = RptSamplingRateVoltage
 	if rsp, err = ln.lmrCmdRsp(&cmd); err != nil {
 		return err
@@ -282,12 +301,21 @@ func (ln *Lane) readLaneParameters() error {
 	}
 
 	m := &ocppb.Measurement{
-		Name:           fmt.Sprintf("LN=%02d;Lane-Parameters", ln.laneNumber),
+		Name:           ln.ocpMeasName("Lane-Parameters"),
 		Value:          structpb.NewStringValue(string(data)),
-		HardwareInfoId: ln.rx.hwinfo,
+		HardwareInfoId: ln.ocpHwInfo(),
+	}
+	if !ocpLegacy {
+		// The parameters are a JSON object rather than a JSON string.
+		var v structpb.Struct
+		if err := pbj.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		m.Value = structpb.NewStructValue(&v)
+		m.Subcomponent = ln.ocpSubcomponent()
+		m.Metadata = ln.ocpMetadata(map[string]any{})
 	}
-	ln.mStepArti.Artifact = &ocppb.TestStepArtifact_Measurement{Measurement: m}
-	outputArtifact(ln.stepArtiOut)
+	ln.rx.step.Measurement(m)
 
 	return nil
 }
@@ -314,7 +342,12 @@ func (ln *Lane) prepareMarginTests(msg *strings.Builder) []aspect {
 
 	// Margins voltage if supported and specified
 	if ln.Vspec != nil {
-		if param.GetVoltageSupported() {
+		if ln.rx.quirk.GetSkipVoltage() {
+			ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: Voltage margining specified but skipped by quirk %q",
+				ln.laneNumber, ln.rx.quirk.GetName())
+			msg.WriteString("Voltage margining specified but skipped by quirk. | ")
+			ln.Vspec = nil
+		} else if param.GetVoltageSupported() {
 			aspects = append(aspects, aspect{
 				VnotT:     true,
 				spec:      ln.Vspec,
@@ -325,6 +358,8 @@ func (ln *Lane) prepareMarginTests(msg *strings.Builder) []aspect {
 				dirmask:   VoltageDirMask,
 			})
 		} else {
+			ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: Voltage margining specified but voltage not supported",
+				ln.laneNumber)
 			msg.WriteString("Voltage margining specified but voltage not supported. | ")
 			ln.Vspec = nil // Ensure Vspec is nil if not supported
 		}
@@ -336,8 +371,9 @@ func (ln *Lane) prepareMarginTests(msg *strings.Builder) []aspect {
 
 // testAspect executes one test from the list.
 func (ln *Lane) testAspect(t *aspect, msg *strings.Builder) error {
+	ln.convertPhysicalOffsets(t, msg)
 	if t.spec.StartOffset == nil && t.spec.TargetOffset == nil && t.spec.EyeSize == nil {
-		log.Warningf("Lane %d: Test spec is empty, skipping", ln.laneNumber)
+		ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: Test spec is empty, skipping", ln.laneNumber)
 		return nil
 	}
 
@@ -369,7 +405,6 @@ func (ln *Lane) setErrLimit(t *aspect, msg *strings.Builder) error {
 	errlimit := uint16(t.spec.GetErrorLimit())
 	cmd.payload = SetErrorCountLimit | errlimit
 	if err := ln.lmrCmdRspEcho(&cmd); err != nil {
-		msg.WriteString(err.Error() + " | ")
 		return fmt.Errorf("failed to set error count limit: %w", err)
 	}
 
@@ -384,8 +419,13 @@ func (ln *Lane) calculateDwellTime(t *aspect) {
 		t.rate = 63
 	}
 	// Calculates minimum dwell time based on bits to be sampled.
-	// Refers to PCIe 5.0 spec 8.4.4: SampleCount = 3*log 2 (number of bits)
-	t.bitCount = math.Pow(2.0, float64(t.spec.GetSamples())/3.0)
+	if t.spec.TargetBer != nil {
+		// The bits are derived from the target BER and confidence.
+		ln.applyTargetBer(t)
+	} else {
+		// Refers to PCIe 5.0 spec 8.4.4: SampleCount = 3*log 2 (number of bits)
+		t.bitCount = math.Pow(2.0, float64(t.spec.GetSamples())/3.0)
+	}
 	// Samples per second. t.rate is define as the # of bits checked out of 64 bits, - 1.
 	t.sps = (float64(t.rate+1) / 64.0) * ln.speed
 	// Expected dwell is bitCount / sps
@@ -404,6 +444,51 @@ func (ln *Lane) calculateDwellTime(t *aspect) {
 	}
 }
 
+// convertPhysicalOffsets converts the %UI or mV offsets in the test spec to the lane's steps.
+// The converted steps overwrite start_offset, step and target_offset of the lane's own spec, so
+// the result records the steps actually margined.
+func (ln *Lane) convertPhysicalOffsets(t *aspect, msg *strings.Builder) {
+	if t.spec.StartOffsetPhys == nil && t.spec.StepPhys == nil && t.spec.TargetOffsetPhys == nil {
+		return
+	}
+	// Physical value per step: %UI for timing, or mV for voltage.
+	unit := "%UI"
+	perStep := float64(t.maxOffset) * 100.0 / float64(t.steps)
+	if t.VnotT {
+		unit = "mV"
+		perStep = float64(t.maxOffset) * 1000.0 / float64(t.steps)
+	}
+	// Rounds up, so that at least the specified physical offset is margined. The small epsilon
+	// keeps float error from adding a step.
+	toSteps := func(v float32) uint32 {
+		if v <= 0 || t.steps == 0 {
+			return 0
+		}
+		return uint32(math.Ceil(float64(v)/perStep - 1e-6))
+	}
+
+	if t.spec.StartOffsetPhys != nil {
+		start := toSteps(t.spec.GetStartOffsetPhys())
+		t.spec.StartOffset = &start
+		fmt.Fprintf(msg, "start_offset_phys=%.2f%s -> %d steps | ", t.spec.GetStartOffsetPhys(), unit, start)
+	}
+	if t.spec.StepPhys != nil {
+		step := toSteps(t.spec.GetStepPhys())
+		if step == 0 {
+			step = 1
+		}
+		t.spec.Step = &step
+		fmt.Fprintf(msg, "step_phys=%.2f%s -> %d steps | ", t.spec.GetStepPhys(), unit, step)
+	}
+	if t.spec.TargetOffsetPhys != nil {
+		target := toSteps(t.spec.GetTargetOffsetPhys())
+		t.spec.TargetOffset = &target
+		fmt.Fprintf(msg, "target_offset_phys=%.2f%s -> %d steps | ", t.spec.GetTargetOffsetPhys(), unit, target)
+	}
+	log.V(1).Infof("Lane %d: %.4f%s per step; physical offsets converted to start=%d, step=%d, target=%d",
+		ln.laneNumber, perStep, unit, t.spec.GetStartOffset(), t.spec.GetStep(), t.spec.GetTargetOffset())
+}
+
 // determineMarginRange sets the starting, target, and step for margining.
 func (ln *Lane) determineMarginRange(t *aspect) {
 	t.eyeSizeMode = false
@@ -418,7 +503,7 @@ func (ln *Lane) determineMarginRange(t *aspect) {
 	if t.spec.Step != nil {
 		t.step = uint16(t.spec.GetStep())
 		if t.step == 0 {
-			log.Warningf("Lane %d: step cannot be 0, adjusting to 1", ln.laneNumber)
+			ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: step cannot be 0, adjusting to 1", ln.laneNumber)
 			t.step = 1
 		}
 	}
@@ -445,7 +530,8 @@ func (ln *Lane) determineMarginRange(t *aspect) {
 	if t.spec.TargetOffset != nil {
 		// Set the target max offset to be no greater than the Lane's capability.
 		if t.spec.GetTargetOffset() > t.steps {
-			log.Warningf("Lane %d: target_offset %d exceeds capability %d, adjusting", ln.laneNumber, *t.spec.TargetOffset, t.steps)
+			ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: target_offset %d exceeds capability %d, adjusting",
+				ln.laneNumber, *t.spec.TargetOffset, t.steps)
 			*t.spec.TargetOffset = t.steps
 		}
 		t.target = uint16(t.spec.GetTargetOffset())
@@ -462,7 +548,8 @@ func (ln *Lane) determineMarginRange(t *aspect) {
 		t.start = uint16(*t.spec.StartOffset)
 		// Step, if specified, must be no greater than the target.
 		if t.start > t.target {
-			log.Warningf("Lane %d: start_offset %d > target_offset %d, adjusting start = target", ln.laneNumber, t.start, t.target)
+			ocpout.Warningf(ln.rx.step, ln.ocpHwInfo(), "Lane %d: start_offset %d > target_offset %d, adjusting start = target",
+				ln.laneNumber, t.start, t.target)
 			t.start = t.target
 		}
 	} else {
@@ -517,7 +604,7 @@ func (ln *Lane) scanEye(t *aspect, msg *strings.Builder) {
 		// Theoretically, IndErrorSampler avoids it. However, it's not true on some retimer devices.
 		if t.mp[pos][fail] == nil {
 			if mp, err = ln.margin(offset, t); err != nil {
-				msg.WriteString(err.Error() + " | ")
+				ln.laneError(msg, "pcie_lmt-lmr-cmd-error", err)
 			}
 
 			passPos = mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING
@@ -540,7 +627,7 @@ func (ln *Lane) scanEye(t *aspect, msg *strings.Builder) {
 			if t.mp[neg][fail] == nil {
 
 				if mp, err = ln.margin(offset|t.dirmask, t); err != nil {
-					msg.WriteString(err.Error() + " | ")
+					ln.laneError(msg, "pcie_lmt-lmr-cmd-error", err)
 				}
 
 				passNeg = mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING
@@ -584,7 +671,7 @@ RedoPos: // Redo the positive offset if the eye center is more positive.
 	for offset = t.start - offset; ; { // Start from positive half of the eye size rounding up.
 		// margin at offset downwards towards the positive target, or if passing.
 		if mp, err = ln.margin(offset, t); err != nil {
-			msg.WriteString(err.Error() + " | ")
+			ln.laneError(msg, "pcie_lmt-lmr-cmd-error", err)
 		}
 		passPos = mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING
 
@@ -626,7 +713,7 @@ RedoPos: // Redo the positive offset if the eye center is more positive.
 	for offset = t.start - offset; ; { // Start from eye_size - positive passing offset.
 		// margin at negative offset upwards towards the negative target, or if passing.
 		if mp, err = ln.margin(offset|t.dirmask, t); err != nil {
-			msg.WriteString(err.Error() + " | ")
+			ln.laneError(msg, "pcie_lmt-lmr-cmd-error", err)
 		}
 		passNeg = mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING
 
@@ -655,8 +742,10 @@ RedoPos: // Redo the positive offset if the eye center is more positive.
 
 // outputEyeMeasurement processes margin results, printing to console and generating OCP artifacts.
 func (ln *Lane) outputEyeMeasurement(t *aspect) {
-	m := &ocppb.Measurement{HardwareInfoId: ln.rx.hwinfo}
-	ln.mStepArti.Artifact = &ocppb.TestStepArtifact_Measurement{Measurement: m}
+	m := &ocppb.Measurement{HardwareInfoId: ln.ocpHwInfo()}
+	if !ocpLegacy {
+		m.Subcomponent = ln.ocpSubcomponent()
+	}
 
 	vt := 1
 	if t.VnotT {
@@ -668,7 +757,7 @@ func (ln *Lane) outputEyeMeasurement(t *aspect) {
 		{"RIGHT", "LEFT"},
 	}
 	MeasUnit := [2]string{"V", "UI"}
-	MeasPF := [2]string{"MAX-PASSING", "MIN-FAILING"}
+	MeasPF := [2]string{cornerMaxPassing, cornerMinFailing}
 
 	for pn := pos; pn <= neg; pn++ { // 0: Pos, 1: Neg
 		for pf := pass; pf <= fail; pf++ {
@@ -689,11 +778,25 @@ func (ln *Lane) outputEyeMeasurement(t *aspect) {
 			fmt.Println(ln.rx.hwinfo, ";LN=", ln.laneNumber, ";", name, ":", value, MeasUnit[vt], ";Step=", mp.GetSteps())
 
 			if t.eyeScanMode {
-				m.Name = fmt.Sprintf("LN=%02d;%s-%s-%s", ln.laneNumber, MeasPF[pf], MeasUnit[vt], MeasDir[vt][pn])
-				m.Unit = fmt.Sprintf("Unit=%s;BER=%.2E", MeasUnit[vt], t.berThresh)
+				m.Name = ln.ocpMeasName(fmt.Sprintf("%s-%s-%s", MeasPF[pf], MeasUnit[vt], MeasDir[vt][pn]))
 				m.Value = structpb.NewNumberValue(value)
 				m.Validators = nil // Clear validators from any previous artifact.
-				outputArtifact(ln.stepArtiOut)
+				// The passing corner isn't streamed as a point in the eye scan mode.
+				meta := map[string]any{
+					"steps":       mp.GetSteps(),
+					"direction":   mp.GetDirection().String(),
+					"error_count": mp.GetErrorCount(),
+				}
+				if ocpLegacy {
+					m.Unit = fmt.Sprintf("Unit=%s;BER=%.2E", MeasUnit[vt], t.berThresh)
+				} else {
+					m.Unit = MeasUnit[vt]
+					meta["aspect"] = ocpAspect(t)
+					meta["corner"] = MeasPF[pf]
+					meta["ber_threshold"] = t.berThresh
+				}
+				m.Metadata = ln.ocpMetadata(meta)
+				ln.rx.step.Measurement(m)
 			}
 		}
 	}
@@ -707,8 +810,8 @@ func (ln *Lane) outputEyeMeasurement(t *aspect) {
 func (ln *Lane) outputEyeSizeArtifact(m *ocppb.Measurement, t *aspect) {
 	var totalSize float32
 	if t.VnotT {
-		m.Name = fmt.Sprintf("LN=%02d;Eye-Height", ln.laneNumber)
-		m.Unit = fmt.Sprintf("Unit=V;BER=%.2E", t.berThresh)
+		m.Name = ln.ocpMeasName("Eye-Height")
+		m.Unit = "V"
 		if t.mp[pos][pass] != nil {
 			totalSize += t.mp[pos][pass].GetVoltage()
 		}
@@ -716,9 +819,10 @@ func (ln *Lane) outputEyeSizeArtifact(m *ocppb.Measurement, t *aspect) {
 			totalSize += t.mp[neg][pass].GetVoltage()
 		}
 		ln.eyeHeight = totalSize
+		ln.hasEyeHeight = true
 	} else {
-		m.Name = fmt.Sprintf("LN=%02d;Eye-Width", ln.laneNumber)
-		m.Unit = fmt.Sprintf("Unit=UI;BER=%.2E", t.berThresh)
+		m.Name = ln.ocpMeasName("Eye-Width")
+		m.Unit = "UI"
 		if t.mp[pos][pass] != nil {
 			totalSize += t.mp[pos][pass].GetPercentUi()
 		}
@@ -726,9 +830,16 @@ func (ln *Lane) outputEyeSizeArtifact(m *ocppb.Measurement, t *aspect) {
 			totalSize += t.mp[neg][pass].GetPercentUi()
 		}
 		ln.eyeWidth = totalSize
+		ln.hasEyeWidth = true
 	}
 
 	m.Value = structpb.NewNumberValue(float64(totalSize))
+	if ocpLegacy {
+		m.Unit = fmt.Sprintf("Unit=%s;BER=%.2E", m.Unit, t.berThresh)
+		m.Metadata = nil
+	} else {
+		m.Metadata = ln.ocpMetadata(map[string]any{"aspect": ocpAspect(t), "ber_threshold": t.berThresh})
+	}
 	if t.spec.EyeSize != nil {
 		if totalSize < t.spec.GetEyeSize() {
 			ln.Pass = false
@@ -741,5 +852,5 @@ func (ln *Lane) outputEyeSizeArtifact(m *ocppb.Measurement, t *aspect) {
 	} else {
 		m.Validators = nil
 	}
-	outputArtifact(ln.stepArtiOut)
+	ln.rx.step.Measurement(m)
 }
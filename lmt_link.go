@@ -27,12 +27,12 @@ import (
 import (
 	"fmt"
 	"slices"
-	"strings"
 	"sync"
 
 	log "github.com/golang/glog"
 	structpb "google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/proto"
+	"local/ocpout"
 	ocppb "ocpdiag/results_go_proto"
 	lmtpb "lmt_go.proto"
 	pci "pciutils"
@@ -52,10 +52,9 @@ func (lt *linktest) marginLink() {
 	// Collects only those lanes to be tested in an array slice.
 	cfg := lt.pb
 	// Reads if retimer presents
-	addr := lt.dsp.pcieCapOffset + C.PCI_EXP_LNKSTA2
-	val := pci.ReadWord(lt.dsp.dev, addr)
-	retimer0 := (val & C.PCI_EXP_LINKSTA2_RETIMER) != 0
-	retimer1 := (val & C.PCI_EXP_LINKSTA2_2RETIMERS) != 0
+	retimers := lt.retimersPresent()
+	retimer0 := retimers[0]
+	retimer1 := retimers[1]
 	// Receiver ports and lanes initialization
 	for i := range lt.allRx {
 		// The index corresponds to the receiver number, where 0 is for broadcasting. not an actual
@@ -88,34 +87,49 @@ func (lt *linktest) marginLink() {
 		} else {
 			rxpt.port = lt.dsp
 		}
-		rxpt.hwinfo = "BDF=" + rxpt.port.dev.BDFString() + ";RX=" + strings.TrimPrefix(rxpt.rec.String(), "R_")
+		rxpt.hwinfo = rxHwInfoID(rxpt.port.dev, rxpt.rec)
+		if r := retimerIndex(rxpt.rec); r >= 0 {
+			rxpt.retimer = lt.retimers[r]
+		}
 		rxpt.linkwg = lt.wg
+		rxpt.quirk = lt.findQuirk(rxpt.rec)
 		rxpt.rxwg = new(sync.WaitGroup)
 		rxpt.lanes = make([]*Lane, rxpt.port.width, rxpt.port.width)
 		for i := range rxpt.lanes {
 			rxpt.lanes[i] = new(Lane)
 			rxpt.lanes[i].Init(lt.pb, rxpt.port.dev, i, rxpt.port.lmrAddr,
 				rxpt.rec, rxpt.port.speed, rxpt.rxwg, rxpt.linkwg, rxpt)
+			rxpt.lanes[i].eq = rxpt.port.readEqualization(i)
 		}
 		// Run lanes in parallel if the receiver lane has independent error sampler.
 		if rxpt.parallel, err = rxpt.lanes[0].GetIndErrorSampler(); err != nil {
-			message := lt.pb.GetMessage() + err.Error() + " | "
+			message := lt.pb.GetMessage() + ocpout.Errorf(lt.run, rxpt.hwinfo, "pcie_lmt-lmr-cmd-error",
+				"Reading the independent error sampler failed: %v", err) + " | "
 			lt.pb.Message = &message
 		}
+		// Some retimers break when parameter reading overlaps margining, even with an
+		// independent error sampler.
+		if rxpt.quirk.GetSerialLanes() {
+			rxpt.parallel = false
+		}
+		if rxpt.quirk != nil {
+			log.V(1).Infof("%s: %s", rxpt.hwinfo, quirkString(rxpt.quirk))
+		}
 	}
 
 	// Enlists the test specs from config.
 	for _, spec := range cfg.GetTestSpecs() {
 		if spec.GetReceiver() == lmtpb.LinkMargin_R_BROADCAST0 ||
 			spec.GetReceiver() == lmtpb.LinkMargin_R_RESERVED {
-			log.Warningf("Illegal test_specs receiver: %s. The test_spec is ignored.",
-				spec.GetReceiver().String())
+			ocpout.Warningf(lt.run, ocpout.PortHwInfoID(lt.usp.dev.BDFString()),
+				"Illegal test_specs receiver: %s. The test_spec is ignored.", spec.GetReceiver().String())
 			continue
 		}
 
 		rxpt := lt.allRx[spec.GetReceiver()]
 		if rxpt == nil {
-			log.Warningf("The test_specs receiver: %s is not present on the link. The test_spec is ignored.",
+			ocpout.Warningf(lt.run, ocpout.PortHwInfoID(lt.usp.dev.BDFString()),
+				"The test_specs receiver: %s is not present on the link. The test_spec is ignored.",
 				spec.GetReceiver().String())
 			continue
 		}
@@ -123,8 +137,8 @@ func (lt *linktest) marginLink() {
 		rxpt.testReady = true
 		if spec.GetAspect() != lmtpb.LinkMargin_M_VOLTAGE &&
 			spec.GetAspect() != lmtpb.LinkMargin_M_TIMING {
-			log.Warningf("The test_spec is missing the aspect (T or V). The test_spec is ignored.",
-				spec.GetReceiver().String())
+			ocpout.Warningf(lt.run, rxpt.hwinfo,
+				"The test_spec is missing the aspect (T or V). The test_spec is ignored.")
 			rxpt.testReady = false
 		} else {
 			for n, lane := range rxpt.lanes {
@@ -158,18 +172,9 @@ func (lt *linktest) marginLink() {
 		log.V(1).Infoln("Margining lanes at receiver: ", r.rec.String())
 
 		// OCP TestStepStart
-		stepStart := &ocppb.TestStepStart{
-			Name: "LMT@" + r.hwinfo,
-		}
-		stepArti := &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_TestStepStart{stepStart},
-			TestStepId: r.hwinfo,
-		}
-		outArti := &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{stepArti},
-		}
-		outputArtifact(outArti)
+		r.step = lt.run.StartStep(ocpStepPrefix+lt.stepPrefix+r.hwinfo, "LMT@"+lt.stepPrefix+r.hwinfo)
 
+		preHealth := lt.readLinkHealth()
 		for _, ln := range r.lanes {
 			if ln.Vspec == nil && ln.Tspec == nil {
 				continue
@@ -203,21 +208,29 @@ func (lt *linktest) marginLink() {
 			}
 		}
 
+		// Checks for errors and link recovery caused by margining.
+		healthy := lt.checkLinkHealth(r, preHealth)
+
 		// Checks if the link is still at the same width and speed.
-		addr := r.port.pcieCapOffset + C.PCI_EXP_LNKSTA
-		val := pci.ReadWord(r.port.dev, addr)
-		width := uint32((val & C.PCI_EXP_LNKSTA_WIDTH) >> LinkStatusWidthPos)
-		gen := uint32(val & C.PCI_EXP_LNKSTA_SPEED)
+		gen, width := r.port.linkStatus()
 
 		if width != r.port.width || gen != r.port.gen {
 			linkcheck = false
 			message := fmt.Sprintf("Link width/speed changed from gen%dx%d to gen%dx%d.",
 				r.port.gen, r.port.width, gen, width)
-			log.Errorf("%s Post margin at %s, %s", r.port.dev.BDFString(), r.rec.String(), message)
+			ocpout.Logf(r.step, ocppb.Log_ERROR, r.hwinfo, "Post margin: %s", message)
 
 			fullMessage := lt.pb.GetMessage() + message + " | "
 			lt.pb.Message = &fullMessage
 		}
+		lt.pb.LinkChecks = append(lt.pb.LinkChecks, &lmtpb.LinkMargin_LinkCheck{
+			Receiver:      r.rec,
+			Gen:           gen,
+			Width:         width,
+			ExpectedGen:   r.port.gen,
+			ExpectedWidth: r.port.width,
+			Healthy:       healthy,
+		})
 
 		validator := &ocppb.Validator{
 			Name:  "Link Width Check",
@@ -230,14 +243,7 @@ func (lt *linktest) marginLink() {
 			HardwareInfoId: r.hwinfo,
 			Validators:     []*ocppb.Validator{validator},
 		}
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_Measurement{Measurement: m},
-			TestStepId: r.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{stepArti},
-		}
-		outputArtifact(outArti)
+		r.step.Measurement(m)
 
 		validator = &ocppb.Validator{
 			Name:  "Link Speed Check",
@@ -250,14 +256,7 @@ func (lt *linktest) marginLink() {
 			HardwareInfoId: r.hwinfo,
 			Validators:     []*ocppb.Validator{validator},
 		}
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_Measurement{Measurement: m},
-			TestStepId: r.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{stepArti},
-		}
-		outputArtifact(outArti)
+		r.step.Measurement(m)
 
 		diag := &ocppb.Diagnosis{
 			Type:           ocppb.Diagnosis_UNKNOWN,
@@ -268,6 +267,11 @@ func (lt *linktest) marginLink() {
 			diag.Verdict = "pcie_lmt-rx_ln-fail"
 			diag.Message = fmt.Sprintf("Link width/speed changed from gen%dx%d to gen%dx%d.",
 				r.port.gen, r.port.width, gen, width)
+		} else if !healthy {
+			linkcheck = false
+			diag.Type = ocppb.Diagnosis_FAIL
+			diag.Verdict = "pcie_lmt-rx_link-health-fail"
+			diag.Message = "Uncorrectable error or link down after margining."
 		} else if lncnt == 0 {
 			diag.Verdict = "pcie_lmt-rx_ln-unknown"
 			diag.Message = "0 Rx-lane tested."
@@ -281,27 +285,15 @@ func (lt *linktest) marginLink() {
 			diag.Message = fmt.Sprintf("%d Rx-lane tested; %d failed.", lncnt, failcnt)
 		}
 
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_Diagnosis{diag},
-			TestStepId: r.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{stepArti},
+		r.step.Diagnosis(diag)
+
+		// Recovers the link for the rest of the receivers, if a recovery policy is specified.
+		if !linkcheck {
+			linkcheck = lt.recoverLink(r)
 		}
-		outputArtifact(outArti)
 
 		// OCP TestStepEnd
-		stepEnd := &ocppb.TestStepEnd{
-			Status: ocppb.TestRunEnd_COMPLETE,
-		}
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_TestStepEnd{stepEnd},
-			TestStepId: r.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{stepArti},
-		}
-		outputArtifact(outArti)
+		r.step.End(ocppb.TestRunEnd_COMPLETE)
 	}
 
 	lt.pb.ReceiverLanes = lanes
@@ -325,6 +317,8 @@ func (ln *Lane) GatherResult() *lmtpb.LinkMargin_Lane {
 		ln.lane.EyeHeight = &ln.eyeHeight
 	}
 	ln.lane.LaneParameter = ln.param
+	ln.lane.Retimer = ln.rx.retimer
+	ln.lane.Equalization = ln.eq
 	ln.lane.ExtraInfo = &ln.msg
 	ln.lane.Pass = &ln.Pass
 	return ln.lane
@@ -341,27 +335,48 @@ func (ln *Lane) GatherResult() *lmtpb.LinkMargin_Lane {
 // If writeable, the Hardware Autonomous Width Disable bit of the Link Control
 // register must be Set in both the	Downstream Port and Upstream Port.
 
-// prepLink saves the state of the Hardware Autonomous Speed Disable and
-// the Hardware Autonomous Width Disable, and clears the ASPM control.
+// prepLink saves the state of the Hardware Autonomous Speed Disable,
+// the Hardware Autonomous Width Disable and the Target Link Speed, and clears
+// the ASPM control.
 func (lt *linktest) prepLink() {
+	for _, p := range [2]*port{lt.dsp, lt.usp} {
+		val := pci.ReadWord(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKCTL)
+		p.hawd = (val & C.PCI_EXP_LNKCTL_HWAUTWD) != 0
+		val = pci.ReadWord(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKCTL2)
+		p.hasd = (val & C.PCI_EXP_LNKCTL2_SPEED_DIS) != 0
+		p.tls = val & lnkCtl2TargetSpeed
+	}
+	lt.applyLinkSettings()
+}
+
+// applyLinkSettings sets the Hardware Autonomous Speed Disable and the Hardware Autonomous
+// Width Disable, and clears the ASPM control, without saving the state.
+func (lt *linktest) applyLinkSettings() {
 	for _, p := range [2]*port{lt.dsp, lt.usp} {
 		addr := p.pcieCapOffset + C.PCI_EXP_LNKCTL
 		val := pci.ReadWord(p.dev, addr)
-		p.hawd = (val & C.PCI_EXP_LNKCTL_HWAUTWD) != 0
 		val = val | C.PCI_EXP_LNKCTL_HWAUTWD
 		val = val &^ C.PCI_EXP_LNKCTL_ASPM
 		pci.WriteWord(p.dev, addr, val)
 
 		addr = p.pcieCapOffset + C.PCI_EXP_LNKCTL2
 		val = pci.ReadWord(p.dev, addr)
-		p.hasd = (val & C.PCI_EXP_LNKCTL2_SPEED_DIS) != 0
 		val = val | C.PCI_EXP_LNKCTL2_SPEED_DIS
 		pci.WriteWord(p.dev, addr, val)
 	}
 }
 
-// restoreLink restores the state of the Hardware Autonomous Speed Disable and
-// the Hardware Autonomous Width Disable.
+// linkStatus reads the current link speed and width of the port.
+func (p *port) linkStatus() (gen, width uint32) {
+	val := pci.ReadWord(p.dev, p.pcieCapOffset+C.PCI_EXP_LNKSTA)
+	width = uint32((val & C.PCI_EXP_LNKSTA_WIDTH) >> LinkStatusWidthPos)
+	gen = uint32(val & C.PCI_EXP_LNKSTA_SPEED)
+	return gen, width
+}
+
+// restoreLink restores the state of the Hardware Autonomous Speed Disable,
+// the Hardware Autonomous Width Disable and the Target Link Speed. The Target
+// Link Speed takes effect at the next retrain.
 // When the margin testing procedure is completed, the state of the
 // Hardware Autonomous Speed Disable bit and the Hardware Autonomous Width
 // Disable bit must be restored to the previously saved values.
@@ -383,6 +398,7 @@ func (lt *linktest) restoreLink() {
 		} else {
 			val = val &^ C.PCI_EXP_LNKCTL2_SPEED_DIS
 		}
+		val = val&^lnkCtl2TargetSpeed | p.tls
 		pci.WriteWord(p.dev, addr, val)
 	}
 }
@@ -0,0 +1,78 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Margin checks for the LTT, e.g. a quick target-offset check after every N link trainings.
+
+import (
+	"fmt"
+
+	lmtpb "lmt_go.proto"
+	"local/ocpout"
+	pci "pciutils"
+)
+
+// MarginChecker margins the links for the LTT margin checks. The LTT can't import the
+// lanemargintest, which imports it, so the binary registers it with linktrain.SetMarginChecker.
+type MarginChecker struct{}
+
+// CheckMargin margins the link of the USP by the test specs of the spec, and returns the result
+// of the link with its receiver lanes. The OCP artifacts of the margining are discarded, as the
+// LTT streams the eye margins in its own MeasurementSeries.
+func (MarginChecker) CheckMargin(usp pci.Dev, spec *lmtpb.LinkMargin) (*lmtpb.LinkMargin, error) {
+	lt, err := checkMargin(usp, spec, ocpout.NewRun(nil, "pcie_lmt_check", "", ""), "")
+	if lt == nil {
+		return nil, err
+	}
+	return lt.pb, err
+}
+
+// checkMargin margins the link of the USP by the test specs of the spec, streaming the OCP
+// artifacts to run with the test_step_ids prefixed by stepPrefix, e.g. "PRESET=P3;" of a sweep
+// point. It returns the linktest margined, or the linktest not ready with an error.
+func checkMargin(usp pci.Dev, spec *lmtpb.LinkMargin, run *ocpout.Run, stepPrefix string) (*linktest, error) {
+	lt, err := newLinktest(usp, spec, run)
+	if err != nil {
+		return nil, err
+	}
+	lt.stepPrefix = stepPrefix
+	if !lt.testReady {
+		return lt, fmt.Errorf("the link is not ready for margining: %s", lt.pb.GetMessage())
+	}
+	lt.marginLink()
+	lt.clearUnmeasuredEyes()
+	return lt, nil
+}
+
+// clearUnmeasuredEyes clears the eye sizes of the lane results not measured, e.g. of a
+// target_offset check, which are left 0 as if the eye were closed.
+func (lt *linktest) clearUnmeasuredEyes() {
+	for _, rx := range lt.allRx {
+		if rx == nil {
+			continue
+		}
+		for _, ln := range rx.lanes {
+			if ln.lane == nil {
+				continue
+			}
+			if !ln.hasEyeWidth {
+				ln.lane.EyeWidth = nil
+			}
+			if !ln.hasEyeHeight {
+				ln.lane.EyeHeight = nil
+			}
+		}
+	}
+}
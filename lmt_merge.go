@@ -0,0 +1,162 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Merges the results from many hosts, and computes the population statistics of the eye sizes
+// per (vendor, device, receiver, lane), to spot outlier lanes across a fleet.
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/golang/glog"
+	lmtpb "lmt_go.proto"
+)
+
+// MergeResults reads the result files into one lmts result and writes it to outfn. Each link is
+// tagged with the file it's merged from. The host is tagged at test time.
+func MergeResults(resfns []string, outfn string) error {
+	merged := new(lmtpb.LinkMarginTest)
+	for _, fn := range resfns {
+		ReadResult(fn)
+		for _, lm := range lmts.GetLinkMargin() {
+			source := fn
+			lm.Source = &source
+			merged.LinkMargin = append(merged.LinkMargin, lm)
+		}
+	}
+	lmts = merged
+	log.Infof("Merged %d links from %d result files.", len(lmts.GetLinkMargin()), len(resfns))
+	return writeLmtsPbtxt(outfn)
+}
+
+// populationKey groups the lanes of the same kind across hosts.
+type populationKey struct {
+	vendorID, deviceID uint32
+	receiver           lmtpb.LinkMargin_ReceiverEnum
+	lane               uint32
+}
+
+// populationSample is an eye size of a lane and where it comes from.
+type populationSample struct {
+	value float64
+	where string // host or source file, and the USP BDF
+}
+
+// percentile interpolates the p-th percentile (0-100) of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo))
+}
+
+// WritePopulationStats writes the eye width and height statistics of the lmts result per
+// (vendor, device, receiver, lane) to a csv file. The outliers are the lanes below the lower
+// Tukey fence, Q1 - 1.5 * IQR, as a small eye is the concern.
+func WritePopulationStats(csvfn string) {
+	widths := make(map[populationKey][]populationSample)
+	heights := make(map[populationKey][]populationSample)
+	fails := make(map[populationKey]int)
+	for _, lm := range lmts.GetLinkMargin() {
+		where := lm.GetHost()
+		if where == "" {
+			where = lm.GetSource()
+		}
+		where = where + "/" + lm.GetUspBdf()
+		for _, ln := range lm.GetReceiverLanes() {
+			key := populationKey{lm.GetVendorId(), lm.GetDeviceId(), ln.GetReceiver(), ln.GetLaneNumber()}
+			if ln.EyeWidth != nil {
+				widths[key] = append(widths[key], populationSample{float64(ln.GetEyeWidth()), where})
+			}
+			if ln.EyeHeight != nil {
+				heights[key] = append(heights[key], populationSample{float64(ln.GetEyeHeight()), where})
+			}
+			if !ln.GetPass() {
+				fails[key]++
+			}
+		}
+	}
+
+	f, err := os.Create(csvfn)
+	if err != nil {
+		log.Exit(err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"vendor_id", "device_id", "receiver", "lane", "metric", "count", "fail_count",
+		"mean", "stddev", "min", "p1", "p5", "p25", "p50", "p75", "p95", "p99", "max", "low_outliers"})
+	for _, m := range []struct {
+		name    string
+		samples map[populationKey][]populationSample
+	}{{"eye_width_ui", widths}, {"eye_height_v", heights}} {
+		keys := make([]populationKey, 0, len(m.samples))
+		for k := range m.samples {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b populationKey) int {
+			return cmp.Or(cmp.Compare(a.vendorID, b.vendorID), cmp.Compare(a.deviceID, b.deviceID),
+				cmp.Compare(a.receiver, b.receiver), cmp.Compare(a.lane, b.lane))
+		})
+		for _, k := range keys {
+			samples := m.samples[k]
+			values := make([]float64, len(samples))
+			var sum float64
+			for i, s := range samples {
+				values[i] = s.value
+				sum += s.value
+			}
+			slices.Sort(values)
+			mean := sum / float64(len(values))
+			var sq float64
+			for _, v := range values {
+				sq += (v - mean) * (v - mean)
+			}
+			stddev := 0.0
+			if len(values) > 1 {
+				stddev = math.Sqrt(sq / float64(len(values)-1))
+			}
+			q1 := percentile(values, 25)
+			q3 := percentile(values, 75)
+			fence := q1 - 1.5*(q3-q1)
+			var outliers []string
+			for _, s := range samples {
+				if s.value < fence {
+					outliers = append(outliers, fmt.Sprintf("%s=%.4f", s.where, s.value))
+				}
+			}
+			r := []string{fmt.Sprintf("%04x", k.vendorID), fmt.Sprintf("%04x", k.deviceID),
+				k.receiver.String(), fmt.Sprint(k.lane), m.name, fmt.Sprint(len(values)),
+				fmt.Sprint(fails[k]), fmt.Sprintf("%f", mean), fmt.Sprintf("%f", stddev)}
+			for _, p := range []float64{0, 1, 5, 25, 50, 75, 95, 99, 100} {
+				r = append(r, fmt.Sprintf("%f", percentile(values, p)))
+			}
+			r = append(r, strings.Join(outliers, " "))
+			w.Write(r)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Exit(err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Exports the latest LMT result as Prometheus metrics in the text exposition format, e.g. for the
+// node_exporter textfile collector. Periodic margining then shows up in the monitoring dashboards.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lmtpb "lmt_go.proto"
+)
+
+// metricFamily is a gauge and how to collect its samples from a link.
+type metricFamily struct {
+	name    string
+	help    string
+	collect func(lm *lmtpb.LinkMargin, emit func(labels string, v float64))
+}
+
+// metricLabel escapes a label value.
+func metricLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// linkLabels are the labels identifying a link.
+func linkLabels(lm *lmtpb.LinkMargin) string {
+	return fmt.Sprintf(`host="%s",usp_bdf="%s",dsp_bdf="%s"`, metricLabel(lm.GetHost()),
+		metricLabel(lm.GetUspBdf()), metricLabel(lm.GetDspBdf()))
+}
+
+// laneLabels are the labels identifying a lane of a receiver on a link.
+func laneLabels(lm *lmtpb.LinkMargin, ln *lmtpb.LinkMargin_Lane) string {
+	return fmt.Sprintf(`%s,receiver="%s",lane="%d"`, linkLabels(lm), ln.GetReceiver().String(),
+		ln.GetLaneNumber())
+}
+
+// boolToFloat converts a pass/fail to a gauge value.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metricFamilies are all the exported gauges.
+var metricFamilies = []metricFamily{
+	{"lmt_lane_pass", "Whether the lane passed margining (1) or not (0).",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, ln := range lm.GetReceiverLanes() {
+				emit(laneLabels(lm, ln), boolToFloat(ln.GetPass()))
+			}
+		}},
+	{"lmt_lane_eye_width_ui", "The eye width of the lane in UI.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, ln := range lm.GetReceiverLanes() {
+				if ln.EyeWidth != nil {
+					emit(laneLabels(lm, ln), float64(ln.GetEyeWidth()))
+				}
+			}
+		}},
+	{"lmt_lane_eye_height_volts", "The eye height of the lane in volts.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, ln := range lm.GetReceiverLanes() {
+				if ln.EyeHeight != nil {
+					emit(laneLabels(lm, ln), float64(ln.GetEyeHeight()))
+				}
+			}
+		}},
+	{"lmt_margin_point_errors", "The error count at a margin point of the lane.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, ln := range lm.GetReceiverLanes() {
+				for _, mp := range append(ln.GetTimingMargins(), ln.GetVoltageMargins()...) {
+					emit(fmt.Sprintf(`%s,direction="%s",steps="%d"`, laneLabels(lm, ln),
+						mp.GetDirection().String(), mp.GetSteps()), float64(mp.GetErrorCount()))
+				}
+			}
+		}},
+	{"lmt_link_width", "The link width after margining the receiver.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, c := range lm.GetLinkChecks() {
+				emit(fmt.Sprintf(`%s,receiver="%s"`, linkLabels(lm), c.GetReceiver().String()),
+					float64(c.GetWidth()))
+			}
+		}},
+	{"lmt_link_width_expected", "The link width before margining.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, c := range lm.GetLinkChecks() {
+				emit(fmt.Sprintf(`%s,receiver="%s"`, linkLabels(lm), c.GetReceiver().String()),
+					float64(c.GetExpectedWidth()))
+			}
+		}},
+	{"lmt_link_speed_gen", "The link speed generation after margining the receiver.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, c := range lm.GetLinkChecks() {
+				emit(fmt.Sprintf(`%s,receiver="%s"`, linkLabels(lm), c.GetReceiver().String()),
+					float64(c.GetGen()))
+			}
+		}},
+	{"lmt_link_speed_gen_expected", "The link speed generation before margining.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, c := range lm.GetLinkChecks() {
+				emit(fmt.Sprintf(`%s,receiver="%s"`, linkLabels(lm), c.GetReceiver().String()),
+					float64(c.GetExpectedGen()))
+			}
+		}},
+	{"lmt_link_check_pass", "Whether the link kept its width, speed and health after margining the receiver.",
+		func(lm *lmtpb.LinkMargin, emit func(string, float64)) {
+			for _, c := range lm.GetLinkChecks() {
+				pass := c.GetHealthy() && c.GetGen() == c.GetExpectedGen() &&
+					c.GetWidth() == c.GetExpectedWidth()
+				emit(fmt.Sprintf(`%s,receiver="%s"`, linkLabels(lm), c.GetReceiver().String()),
+					boolToFloat(pass))
+			}
+		}},
+}
+
+// WriteMetrics writes the lmts result as Prometheus gauges in the text exposition format.
+// The textfile collector rejects a file with a duplicate series, e.g. a margin point re-margined
+// by the eye size check, so the last value per label set is written.
+func WriteMetrics(w io.Writer, t time.Time) error {
+	var b strings.Builder
+	for _, f := range metricFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", f.name, f.help, f.name)
+		var series []string
+		values := make(map[string]float64)
+		for _, lm := range lmts.GetLinkMargin() {
+			f.collect(lm, func(labels string, v float64) {
+				if _, ok := values[labels]; !ok {
+					series = append(series, labels)
+				}
+				values[labels] = v
+			})
+		}
+		for _, labels := range series {
+			fmt.Fprintf(&b, "%s{%s} %g\n", f.name, labels, values[labels])
+		}
+	}
+	fmt.Fprintf(&b, "# HELP lmt_last_run_timestamp_seconds The time the metrics were written.\n"+
+		"# TYPE lmt_last_run_timestamp_seconds gauge\nlmt_last_run_timestamp_seconds %d\n", t.Unix())
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMetricsFile writes the metrics to a .prom file for the textfile collector. The file is
+// replaced by a rename, so the collector never reads a partial file.
+func WriteMetricsFile(fn string) error {
+	f, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := WriteMetrics(f, time.Now()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
@@ -0,0 +1,416 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Rebuilds an LMT result from the OCP artifact stream, for when only the -ocp_pipe output survives,
+// e.g. the process was killed before writing the result. The margin points are parsed from the
+// Step-Status and Step-BER measurements of margin(), and the eye sizes and corners from
+// outputEyeMeasurement(), in either the structured or the legacy format. The error and sample
+// counts are only in the measurement metadata of newer streams; they're missing from the points
+// rebuilt from older streams.
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	lmtpb "lmt_go.proto"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// ocpFields splits an encoded "Key=Value;Key=Value" OCP string into its fields.
+func ocpFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return fields
+}
+
+// sweepStep tells whether the test step is of a sweep, e.g. the preset sweep step or the step of a
+// receiver margined at the preset P3. A sweep margins the same lanes at many points, so its steps
+// are not rebuilt into the lanes.
+func sweepStep(stepID string) bool {
+	id := ocpFields(stepID)
+	for _, key := range []string{"PRESET", "GEN", "WIDTH"} {
+		if _, ok := id[key]; ok {
+			return true
+		}
+	}
+	for _, tag := range strings.Split(stepID, ";") {
+		switch tag {
+		case "PRESET_SWEEP", "SPEED_STEPS", "WIDTH_STEPS":
+			return true
+		}
+	}
+	return false
+}
+
+// ocpLane is a lane being rebuilt, and the last point streamed to merge its measurements.
+type ocpLane struct {
+	ln        *lmtpb.LinkMargin_Lane
+	lastKey   string // the aspect, direction and steps of the last point
+	last      *lmtpb.LinkMargin_Lane_MarginPoint
+	hasStatus bool // the last point has its Step-Status.
+	hasBER    bool // the last point has its Step-BER.
+}
+
+// ocpStream is the state of a stream being rebuilt.
+type ocpStream struct {
+	cfg   *lmtpb.LinkMargin // The test spec from the TestRunStart parameters.
+	run   *lmtpb.LinkMargin_RunInfo
+	links map[string]*lmtpb.LinkMargin // keyed by both the DSP and USP BDFs
+	lanes map[string]*ocpLane          // keyed by the port BDF, the receiver and the lane number
+}
+
+// link finds or adds the link of a port BDF.
+func (s *ocpStream) link(bdf string) *lmtpb.LinkMargin {
+	if lm, ok := s.links[bdf]; ok {
+		return lm
+	}
+	lm := new(lmtpb.LinkMargin)
+	if s.cfg != nil {
+		lm = proto.Clone(s.cfg).(*lmtpb.LinkMargin)
+	}
+	lm.UspBdf = &bdf
+	lm.Bdf = []string{bdf}
+	lm.RunInfo = s.run
+	s.links[bdf] = lm
+	return lm
+}
+
+// runStart reads the test spec and pairs the DSP and USP of the links from the DutInfo.
+func (s *ocpStream) runStart(start *ocppb.TestRunStart) error {
+	if !strings.HasPrefix(start.GetName(), "pcie_lmt") {
+		return fmt.Errorf("not an lmt stream: %q", start.GetName())
+	}
+	s.run = &lmtpb.LinkMargin_RunInfo{Version: start.GetVersion(), CommandLine: start.GetCommandLine()}
+	if start.GetParameters() != nil {
+		data, err := protojson.Marshal(start.GetParameters())
+		if err != nil {
+			return err
+		}
+		s.cfg = new(lmtpb.LinkMargin)
+		opt := protojson.UnmarshalOptions{DiscardUnknown: true}
+		if err := opt.Unmarshal(data, s.cfg); err != nil {
+			return err
+		}
+	}
+	// ocpTestRunStart() lists the DSP then the USP of every link.
+	var dsp string
+	for _, hw := range start.GetDutInfo().GetHardwareInfos() {
+		bdf := ocpFields(hw.GetHardwareInfoId())["BDF"]
+		switch hw.GetName() {
+		case "DSP":
+			dsp = bdf
+		case "USP":
+			lm := s.link(bdf)
+			if dsp != "" {
+				dspBdf := dsp
+				lm.DspBdf = &dspBdf
+				s.links[dsp] = lm
+			}
+			dsp = ""
+		}
+	}
+	return nil
+}
+
+// lane finds or adds the lane of a receiver at the port BDF. The test step is not in the key, so
+// the margin points of a lane streamed by several test steps are merged into one lane.
+func (s *ocpStream) lane(bdf string, rec lmtpb.LinkMargin_ReceiverEnum, number uint32) *ocpLane {
+	key := fmt.Sprintf("%s;%s;%d", bdf, rec.String(), number)
+	if l, ok := s.lanes[key]; ok {
+		return l
+	}
+	pass := true
+	l := &ocpLane{ln: &lmtpb.LinkMargin_Lane{LaneNumber: number, Receiver: rec, Pass: &pass}}
+	lm := s.link(bdf)
+	lm.ReceiverLanes = append(lm.ReceiverLanes, l.ln)
+	s.lanes[key] = l
+	return l
+}
+
+// validate evaluates a validator against the measured value.
+func validate(v *ocppb.Validator, val *structpb.Value) bool {
+	switch v.GetType() {
+	case ocppb.Validator_EQUAL:
+		return val.AsInterface() == v.GetValue().AsInterface()
+	case ocppb.Validator_NOT_EQUAL:
+		return val.AsInterface() != v.GetValue().AsInterface()
+	case ocppb.Validator_LESS_THAN:
+		return val.GetNumberValue() < v.GetValue().GetNumberValue()
+	case ocppb.Validator_LESS_THAN_OR_EQUAL:
+		return val.GetNumberValue() <= v.GetValue().GetNumberValue()
+	case ocppb.Validator_GREATER_THAN:
+		return val.GetNumberValue() > v.GetValue().GetNumberValue()
+	case ocppb.Validator_GREATER_THAN_OR_EQUAL:
+		return val.GetNumberValue() >= v.GetValue().GetNumberValue()
+	case ocppb.Validator_IN_SET, ocppb.Validator_NOT_IN_SET:
+		in := slices.ContainsFunc(v.GetValue().GetListValue().GetValues(), func(e *structpb.Value) bool {
+			return e.AsInterface() == val.AsInterface()
+		})
+		return in == (v.GetType() == ocppb.Validator_IN_SET)
+	}
+	return true
+}
+
+// metaUint32 reads an optional count from the measurement metadata.
+func metaUint32(m *ocppb.Measurement, key string) *uint32 {
+	v, ok := m.GetMetadata().GetFields()[key]
+	if !ok {
+		return nil
+	}
+	u := uint32(v.GetNumberValue())
+	return &u
+}
+
+// point finds or adds the margin point of a Step-Status or Step-BER measurement. Both are streamed
+// one after the other for a point. The point is identified by the metadata of the structured
+// format, or by the Unit string of the legacy format.
+func (l *ocpLane) point(m *ocppb.Measurement, isStatus bool) (*lmtpb.LinkMargin_Lane_MarginPoint, error) {
+	meta := m.GetMetadata().GetFields()
+	mp := &lmtpb.LinkMargin_Lane_MarginPoint{Status: lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING}
+	var dir, unit string
+	var offset float64
+	if _, ok := meta["steps"]; ok {
+		dir = meta["direction"].GetStringValue()
+		mp.Steps = uint32(meta["steps"].GetNumberValue())
+		offset = meta["offset"].GetNumberValue()
+		unit = meta["offset_unit"].GetStringValue()
+	} else {
+		fields := ocpFields(m.GetUnit())
+		steps, err := strconv.ParseUint(fields["Step"], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad Step in %q: %v", m.GetUnit(), err)
+		}
+		if offset, err = strconv.ParseFloat(fields["Offset"], 32); err != nil {
+			return nil, fmt.Errorf("bad Offset in %q: %v", m.GetUnit(), err)
+		}
+		dir = "D_" + fields["Dir"]
+		mp.Steps = uint32(steps)
+		unit = fields["Unit"]
+	}
+	mp.Direction = lmtpb.LinkMargin_Lane_MarginPoint_DirectionEnum(
+		lmtpb.LinkMargin_Lane_MarginPoint_DirectionEnum_value[dir])
+	key := fmt.Sprintf("%s;%s;%d", unit, dir, mp.GetSteps())
+	if !isStatus && l.hasStatus && !l.hasBER && key == l.lastKey {
+		l.hasBER = true
+		return l.last, nil
+	}
+
+	o := float32(offset)
+	if unit == "V" {
+		mp.Voltage = &o
+		l.ln.VoltageMargins = append(l.ln.VoltageMargins, mp)
+	} else {
+		mp.PercentUi = &o
+		l.ln.TimingMargins = append(l.ln.TimingMargins, mp)
+	}
+	if ec := metaUint32(m, "error_count"); ec != nil {
+		mp.ErrorCount = *ec
+	}
+	mp.SampleCount = metaUint32(m, "sample_count")
+	if v, ok := m.GetMetadata().GetFields()["confidence"]; ok {
+		c := float32(v.GetNumberValue())
+		mp.Confidence = &c
+	}
+	l.last, l.lastKey, l.hasStatus, l.hasBER = mp, key, isStatus, !isStatus
+	return mp, nil
+}
+
+// corner marks the eye corner point of an eye scan measurement, e.g. "MAX-PASSING-UI-RIGHT". The
+// passing corner isn't streamed as a point in the eye scan mode, so it's added from the metadata.
+func (l *ocpLane) corner(name string, m *ocppb.Measurement) {
+	parts := strings.SplitN(name, "-", 4) // MAX, PASSING, UI, RIGHT
+	if len(parts) != 4 {
+		return
+	}
+	info := fmt.Sprintf("EYE CORNER %s %-5s", parts[0]+"-"+parts[1], parts[3])
+	steps := metaUint32(m, "steps")
+	dirName, ok := m.GetMetadata().GetFields()["direction"]
+	if steps == nil || !ok {
+		return // An older stream doesn't identify the point.
+	}
+	dir := lmtpb.LinkMargin_Lane_MarginPoint_DirectionEnum(
+		lmtpb.LinkMargin_Lane_MarginPoint_DirectionEnum_value[dirName.GetStringValue()])
+	points := &l.ln.TimingMargins
+	if parts[2] == "V" {
+		points = &l.ln.VoltageMargins
+	}
+	for i := len(*points) - 1; i >= 0; i-- {
+		if mp := (*points)[i]; mp.GetSteps() == *steps && mp.GetDirection() == dir {
+			mp.Info = &info
+			return
+		}
+	}
+	o := float32(m.GetValue().GetNumberValue())
+	mp := &lmtpb.LinkMargin_Lane_MarginPoint{
+		Direction: dir,
+		Steps:     *steps,
+		Status:    lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING,
+		Info:      &info,
+	}
+	if ec := metaUint32(m, "error_count"); ec != nil {
+		mp.ErrorCount = *ec
+	}
+	if parts[2] == "V" {
+		mp.Voltage = &o
+	} else {
+		mp.PercentUi = &o
+	}
+	*points = append(*points, mp)
+}
+
+// measurement rebuilds the lane result from a lane measurement. The lane is identified by the
+// metadata of the structured format, or by the test step ID and the "LN=nn;<kind>" name of the
+// legacy format.
+func (s *ocpStream) measurement(stepID string, m *ocppb.Measurement) error {
+	var l *ocpLane
+	kind := m.GetName()
+	if meta := m.GetMetadata().GetFields(); meta["lane"] != nil {
+		rec := lmtpb.LinkMargin_ReceiverEnum_value[meta["receiver"].GetStringValue()]
+		l = s.lane(meta["bdf"].GetStringValue(), lmtpb.LinkMargin_ReceiverEnum(rec),
+			uint32(meta["lane"].GetNumberValue()))
+	} else {
+		lnName, lnKind, ok := strings.Cut(m.GetName(), ";")
+		if !ok || !strings.HasPrefix(lnName, "LN=") {
+			return nil // A link measurement, such as the width or the speed.
+		}
+		number, err := strconv.ParseUint(strings.TrimPrefix(lnName, "LN="), 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad lane number in %q: %v", m.GetName(), err)
+		}
+		id := ocpFields(stepID)
+		rec := lmtpb.LinkMargin_ReceiverEnum_value["R_"+id["RX"]]
+		l = s.lane(id["BDF"], lmtpb.LinkMargin_ReceiverEnum(rec), uint32(number))
+		kind = lnKind
+	}
+	for _, v := range m.GetValidators() {
+		if !validate(v, m.GetValue()) {
+			pass := false
+			l.ln.Pass = &pass
+		}
+	}
+
+	switch {
+	case kind == "Lane-Parameters":
+		// A JSON object in the structured format, or a JSON string in the legacy format.
+		data := []byte(m.GetValue().GetStringValue())
+		if v := m.GetValue().GetStructValue(); v != nil {
+			data, _ = protojson.Marshal(v)
+		}
+		param := new(lmtpb.LinkMargin_Lane_Parameters)
+		if err := protojson.Unmarshal(data, param); err != nil {
+			return fmt.Errorf("bad Lane-Parameters of %s LN=%d: %v", stepID, l.ln.GetLaneNumber(), err)
+		}
+		l.ln.LaneParameter = param
+	case kind == "Step-Status":
+		mp, err := l.point(m, true)
+		if err != nil {
+			return err
+		}
+		mp.Status = lmtpb.LinkMargin_Lane_MarginPoint_StatusEnum(
+			lmtpb.LinkMargin_Lane_MarginPoint_StatusEnum_value["S_"+m.GetValue().GetStringValue()])
+	case kind == "Step-BER":
+		if _, err := l.point(m, false); err != nil {
+			return err
+		}
+	case kind == "Eye-Width":
+		w := float32(m.GetValue().GetNumberValue())
+		l.ln.EyeWidth = &w
+	case kind == "Eye-Height":
+		h := float32(m.GetValue().GetNumberValue())
+		l.ln.EyeHeight = &h
+	case strings.HasPrefix(kind, cornerMaxPassing+"-"), strings.HasPrefix(kind, cornerMinFailing+"-"):
+		l.corner(kind, m)
+	}
+	return nil
+}
+
+// ConvertOcpStream rebuilds the lmts result from an OCP artifact stream file, and writes it to
+// outfn. A truncated stream is rebuilt up to its last complete artifact.
+func ConvertOcpStream(streamfn string, outfn string) error {
+	f, err := os.Open(streamfn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := &ocpStream{
+		links: make(map[string]*lmtpb.LinkMargin),
+		lanes: make(map[string]*ocpLane),
+	}
+	opt := protojson.UnmarshalOptions{DiscardUnknown: true}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		arti := new(ocppb.OutputArtifact)
+		if err := opt.Unmarshal(sc.Bytes(), arti); err != nil {
+			log.Warningf("%s:%d: skipping the artifact: %v", streamfn, n, err)
+			continue
+		}
+		if start := arti.GetTestRunArtifact().GetTestRunStart(); start != nil {
+			if err := s.runStart(start); err != nil {
+				return err
+			}
+			continue
+		}
+		step := arti.GetTestStepArtifact()
+		if sweepStep(step.GetTestStepId()) {
+			continue
+		}
+		if m := step.GetMeasurement(); m != nil {
+			if err := s.measurement(step.GetTestStepId(), m); err != nil {
+				return fmt.Errorf("%s:%d: %v", streamfn, n, err)
+			}
+		} else if d := step.GetDiagnosis(); d != nil && d.GetType() == ocppb.Diagnosis_FAIL {
+			lm := s.link(ocpFields(step.GetTestStepId())["BDF"])
+			fullMessage := lm.GetMessage() + d.GetMessage() + " | "
+			lm.Message = &fullMessage
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	lmts = new(lmtpb.LinkMarginTest)
+	for _, lm := range s.links {
+		if !slices.Contains(lmts.LinkMargin, lm) {
+			lmts.LinkMargin = append(lmts.LinkMargin, lm)
+		}
+	}
+	slices.SortFunc(lmts.LinkMargin, func(a, b *lmtpb.LinkMargin) int {
+		return cmp.Compare(bdf2u32(a.GetUspBdf()), bdf2u32(b.GetUspBdf()))
+	})
+	for _, lm := range lmts.LinkMargin {
+		slices.SortStableFunc(lm.ReceiverLanes, func(a, b *lmtpb.LinkMargin_Lane) int {
+			return cmp.Or(cmp.Compare(a.GetReceiver(), b.GetReceiver()),
+				cmp.Compare(a.GetLaneNumber(), b.GetLaneNumber()))
+		})
+	}
+	log.Infof("Rebuilt %d links and %d lanes from %s.", len(lmts.LinkMargin), len(s.lanes), streamfn)
+	return writeLmtsPbtxt(outfn)
+}
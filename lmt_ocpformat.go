@@ -0,0 +1,118 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// The OCP lane measurement formats. The structured format identifies a lane measurement by a
+// HardwareInfo per receiver lane, the Subcomponent of the receiver at the port, and the Metadata
+// of the margin point, so the consumers don't need to parse strings. The legacy format encodes
+// them in strings, e.g. "BDF=...;RX=...;LN=..;Offset=..." in the Subcomponent Location and
+// "Unit=UI;Step=...;Dir=..." in the Unit.
+
+import (
+	"fmt"
+	"strings"
+
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	lmtpb "lmt_go.proto"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// ocpLegacy selects the legacy OCP measurement format.
+var ocpLegacy bool
+
+// SetOcpLegacyFormat selects the legacy OCP measurement format, for the consumers parsing it.
+func SetOcpLegacyFormat(legacy bool) {
+	ocpLegacy = legacy
+}
+
+// laneHwInfoID composes the OCP hardware_info_id of a lane of a receiver.
+func laneHwInfoID(rxHwInfo string, lane uint32) string {
+	return fmt.Sprintf("%s;LN=%02d", rxHwInfo, lane)
+}
+
+// laneHwInfos lists the OCP HardwareInfo of every lane of the receivers present on the link.
+func (lt *linktest) laneHwInfos() []*ocppb.HardwareInfo {
+	recs := []lmtpb.LinkMargin_ReceiverEnum{lmtpb.LinkMargin_R_DSP_A1, lmtpb.LinkMargin_R_USP_F6}
+	retimers := lt.retimersPresent()
+	if retimers[0] {
+		recs = append(recs, lmtpb.LinkMargin_R_RTU_B2, lmtpb.LinkMargin_R_RTD_C3)
+	}
+	if retimers[1] {
+		recs = append(recs, lmtpb.LinkMargin_R_RTU_D4, lmtpb.LinkMargin_R_RTD_E5)
+	}
+	var hwInfos []*ocppb.HardwareInfo
+	for _, rec := range recs {
+		// Other than the USP, all retimer and DSP receivers run from the DSP port.
+		p := lt.dsp
+		if rec == lmtpb.LinkMargin_R_USP_F6 {
+			p = lt.usp
+		}
+		for lane := uint32(0); lane < uint32(p.width); lane++ {
+			hwInfos = append(hwInfos, &ocppb.HardwareInfo{
+				HardwareInfoId: laneHwInfoID(rxHwInfoID(p.dev, rec), lane),
+				Name:           fmt.Sprintf("%s lane %d", strings.TrimPrefix(rec.String(), "R_"), lane),
+				Location:       p.dev.BDFString(),
+				PartType:       "PCIe receiver lane",
+			})
+		}
+	}
+	return hwInfos
+}
+
+// ocpHwInfo is the OCP hardware_info_id of the lane measurements.
+func (ln *Lane) ocpHwInfo() string {
+	if ocpLegacy {
+		return ln.rx.hwinfo
+	}
+	return laneHwInfoID(ln.rx.hwinfo, ln.laneNumber)
+}
+
+// ocpMeasName names a lane measurement. The legacy name is prefixed with the lane number.
+func (ln *Lane) ocpMeasName(kind string) string {
+	if ocpLegacy {
+		return fmt.Sprintf("LN=%02d;%s", ln.laneNumber, kind)
+	}
+	return kind
+}
+
+// ocpSubcomponent is the receiver at the port, where the lane measurements are taken.
+func (ln *Lane) ocpSubcomponent() *ocppb.Subcomponent {
+	return &ocppb.Subcomponent{
+		Type:     ocppb.Subcomponent_BUS,
+		Name:     strings.TrimPrefix(ln.rec.String(), "R_"),
+		Location: ln.dev.BDFString(),
+	}
+}
+
+// ocpMetadata composes the metadata of a lane measurement. The structured format adds the
+// identity of the lane.
+func (ln *Lane) ocpMetadata(fields map[string]any) *structpb.Struct {
+	if !ocpLegacy {
+		fields["usp_bdf"] = ln.cfg.GetUspBdf()
+		fields["bdf"] = ln.dev.BDFString()
+		fields["receiver"] = ln.rec.String()
+		fields["lane"] = ln.laneNumber
+	}
+	metadata, _ := structpb.NewStruct(fields)
+	return metadata
+}
+
+// ocpAspect names the margining aspect in the metadata.
+func ocpAspect(t *aspect) string {
+	if t.VnotT {
+		return lmtpb.LinkMargin_M_VOLTAGE.String()
+	}
+	return lmtpb.LinkMargin_M_TIMING.String()
+}
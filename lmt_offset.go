@@ -202,6 +202,11 @@ looping:
 			bitCount = math.Pow(2.0, float64(samples)/3.0)
 			point.SampleCount = &samples
 		}
+		// Records the effective confidence of meeting the target BER at this point.
+		if t.spec.TargetBer != nil {
+			confidence := float32(berConfidence(bitCount, point.ErrorCount, t.spec.GetTargetBer()))
+			point.Confidence = &confidence
+		}
 	}
 	fmt.Printf(
 		"Point margin: BDF:%s Rx:%-9s Ln:%2d  Dir:%-8s Step:%3d  Status:%-13s ErrCnt:%2d  Samples:%3d\n",
@@ -219,49 +224,75 @@ looping:
 	}
 
 	// Stream OCP TestStepMeasurement artifact
-	var unit string
-	if t.VnotT {
-		unit = fmt.Sprintf("Unit=V;Step=%03d;Dir=%-8s;Offset=%6.4f",
-			point.GetSteps(), strings.TrimPrefix(point.GetDirection().String(), "D_"), point.GetVoltage())
-	} else {
-		unit = fmt.Sprintf("Unit=UI;Step=%03d;Dir=%-8s;Offset=%5.3f",
-			point.GetSteps(), strings.TrimPrefix(point.GetDirection().String(), "D_"), point.GetPercentUi())
+	// The counts are lost in the BER value, so they're kept as metadata to rebuild the result.
+	meta := map[string]any{"error_count": point.GetErrorCount()}
+	if point.SampleCount != nil {
+		meta["sample_count"] = point.GetSampleCount()
 	}
-	subcomp := &ocppb.Subcomponent{
-		Type: ocppb.Subcomponent_BUS,
-		Name: "PCIELMT-MARGINPOINT-PCI",
-		Location: fmt.Sprintf("BDF=%s;RX=%1d;LN=%02d;Offset=%s",
-			ln.cfg.GetBdf()[0], ln.rec.Number(), ln.laneNumber, ocpName),
+	if point.Confidence != nil {
+		meta["confidence"] = point.GetConfidence()
+	}
+	var statusUnit, berUnit string
+	var subcomp *ocppb.Subcomponent
+	if ocpLegacy {
+		if t.VnotT {
+			statusUnit = fmt.Sprintf("Unit=V;Step=%03d;Dir=%-8s;Offset=%6.4f",
+				point.GetSteps(), strings.TrimPrefix(point.GetDirection().String(), "D_"), point.GetVoltage())
+		} else {
+			statusUnit = fmt.Sprintf("Unit=UI;Step=%03d;Dir=%-8s;Offset=%5.3f",
+				point.GetSteps(), strings.TrimPrefix(point.GetDirection().String(), "D_"), point.GetPercentUi())
+		}
+		berUnit = statusUnit
+		subcomp = &ocppb.Subcomponent{
+			Type: ocppb.Subcomponent_BUS,
+			Name: "PCIELMT-MARGINPOINT-PCI",
+			Location: fmt.Sprintf("BDF=%s;RX=%1d;LN=%02d;Offset=%s",
+				ln.cfg.GetBdf()[0], ln.rec.Number(), ln.laneNumber, ocpName),
+		}
+	} else {
+		meta["aspect"] = ocpAspect(t)
+		meta["steps"] = point.GetSteps()
+		meta["direction"] = point.GetDirection().String()
+		if t.VnotT {
+			meta["offset"] = point.GetVoltage()
+			meta["offset_unit"] = "V"
+		} else {
+			meta["offset"] = point.GetPercentUi()
+			meta["offset_unit"] = "UI"
+		}
+		berUnit = "BER"
+		subcomp = ln.ocpSubcomponent()
 	}
+	metadata := ln.ocpMetadata(meta)
 
 	if !t.eyeScanMode || point.GetStatus() != lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING {
 		m := &ocppb.Measurement{
-			Name:           fmt.Sprintf("LN=%02d;Step-Status", ln.laneNumber),
+			Name:           ln.ocpMeasName("Step-Status"),
 			Value:          structpb.NewStringValue(strings.TrimPrefix(point.GetStatus().String(), "S_")),
-			Unit:           unit,
-			HardwareInfoId: ln.rx.hwinfo,
+			Unit:           statusUnit,
+			HardwareInfoId: ln.ocpHwInfo(),
 			Subcomponent:   subcomp,
 			Validators:     []*ocppb.Validator{ln.statusVal},
+			Metadata:       metadata,
 		}
-		ln.mStepArti.Artifact = &ocppb.TestStepArtifact_Measurement{Measurement: m}
-		outputArtifact(ln.stepArtiOut)
+		ln.rx.step.Measurement(m)
 	}
 
 	if (point.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_MARGINING ||
 		point.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_ERROR_OUT) && (!t.eyeScanMode ||
 		point.ErrorCount != 0) {
 		m := &ocppb.Measurement{
-			Name:           fmt.Sprintf("LN=%02d;Step-BER", ln.laneNumber),
+			Name:           ln.ocpMeasName("Step-BER"),
 			Value:          structpb.NewNumberValue(float64(point.ErrorCount) / bitCount),
-			Unit:           unit,
-			HardwareInfoId: ln.rx.hwinfo,
+			Unit:           berUnit,
+			HardwareInfoId: ln.ocpHwInfo(),
 			Subcomponent:   subcomp,
+			Metadata:       metadata,
 		}
 		if !t.errOutOK {
 			m.Validators = []*ocppb.Validator{ln.berVal}
 		}
-		ln.mStepArti.Artifact = &ocppb.TestStepArtifact_Measurement{Measurement: m}
-		outputArtifact(ln.stepArtiOut)
+		ln.rx.step.Measurement(m)
 	}
 
 	// Issues "Clear Error Log" and "Go to Normal Settings" commands
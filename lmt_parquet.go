@@ -0,0 +1,215 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Exports an LMT result to Apache Parquet files for fleet analytics pipelines.
+// The schemas are stable: columns are only appended, never renamed nor retyped.
+// Optional columns are null when the result doesn't have the value.
+
+import (
+	"math"
+	"os"
+
+	log "github.com/golang/glog"
+	"github.com/parquet-go/parquet-go"
+	lmtpb "lmt_go.proto"
+)
+
+// parquetRun is the run metadata repeated in every row, so the rows stay self-describing after
+// the files of many runs are ingested into one table.
+type parquetRun struct {
+	Version     string `parquet:"version"`
+	BuildTime   string `parquet:"build_time"`
+	CommandLine string `parquet:"command_line"`
+	Hostname    string `parquet:"hostname"`
+	Source      string `parquet:"source"`
+	UspBdf      string `parquet:"usp_bdf"`
+	DspBdf      string `parquet:"dsp_bdf"`
+	VendorID    int32  `parquet:"vendor_id"`
+	DeviceID    int32  `parquet:"device_id"`
+	Receiver    string `parquet:"receiver"`
+	Lane        int32  `parquet:"lane"`
+}
+
+// parquetPoint is a row of the margin points file.
+type parquetPoint struct {
+	parquetRun
+	Aspect      string   `parquet:"aspect"`
+	Direction   string   `parquet:"direction"`
+	Steps       int32    `parquet:"steps"`
+	Offset      float64  `parquet:"offset"`
+	Unit        string   `parquet:"unit"`
+	Status      string   `parquet:"status"`
+	ErrorCount  int32    `parquet:"error_count"`
+	SampleCount *int32   `parquet:"sample_count,optional"`
+	Bits        *float64 `parquet:"bits,optional"`
+	Log10Ber    *float64 `parquet:"log10_ber,optional"`
+	Confidence  *float64 `parquet:"confidence,optional"`
+	Info        string   `parquet:"info"`
+	Error       string   `parquet:"error"`
+}
+
+// parquetLane is a row of the lane summary file.
+type parquetLane struct {
+	parquetRun
+	Pass           bool     `parquet:"pass"`
+	EyeWidthUI     *float64 `parquet:"eye_width_ui,optional"`
+	EyeHeightV     *float64 `parquet:"eye_height_v,optional"`
+	LeftUI         *float64 `parquet:"left_ui,optional"`
+	RightUI        *float64 `parquet:"right_ui,optional"`
+	BottomV        *float64 `parquet:"bottom_v,optional"`
+	TopV           *float64 `parquet:"top_v,optional"`
+	TimingPoints   int32    `parquet:"timing_points"`
+	VoltagePoints  int32    `parquet:"voltage_points"`
+	ErrorOutPoints int32    `parquet:"error_out_points"`
+	RetimerVendor  string   `parquet:"retimer_vendor"`
+	RetimerPart    string   `parquet:"retimer_part_number"`
+	RetimerFw      string   `parquet:"retimer_firmware_version"`
+	RetimerSerial  string   `parquet:"retimer_serial_number"`
+	ExtraInfo      string   `parquet:"extra_info"`
+	EqRateGTs      *int32   `parquet:"eq_rate_gts,optional"`
+	DspTxPreset    *int32   `parquet:"dsp_tx_preset,optional"`
+	UspTxPreset    *int32   `parquet:"usp_tx_preset,optional"`
+	EqComplete     *bool    `parquet:"eq_complete,optional"`
+}
+
+// optF64 converts an optional value to a nullable column.
+func optF64(v float32, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	f := float64(v)
+	return &f
+}
+
+// newParquetRun fills the run metadata of a lane.
+func newParquetRun(lm *lmtpb.LinkMargin, ln *lmtpb.LinkMargin_Lane) parquetRun {
+	return parquetRun{
+		Version:     lm.GetRunInfo().GetVersion(),
+		BuildTime:   lm.GetRunInfo().GetBuildTime(),
+		CommandLine: lm.GetRunInfo().GetCommandLine(),
+		Hostname:    lm.GetHost(),
+		Source:      lm.GetSource(),
+		UspBdf:      lm.GetUspBdf(),
+		DspBdf:      lm.GetDspBdf(),
+		VendorID:    int32(lm.GetVendorId()),
+		DeviceID:    int32(lm.GetDeviceId()),
+		Receiver:    ln.GetReceiver().String(),
+		Lane:        int32(ln.GetLaneNumber()),
+	}
+}
+
+// newParquetPoint converts a margin point to a row.
+func newParquetPoint(run parquetRun, ln *lmtpb.LinkMargin_Lane, mp *lmtpb.LinkMargin_Lane_MarginPoint,
+	aspect lmtpb.LinkMargin_MarginAspectEnum) parquetPoint {
+	p := parquetPoint{
+		parquetRun: run,
+		Aspect:     aspect.String(),
+		Direction:  mp.GetDirection().String(),
+		Steps:      int32(mp.GetSteps()),
+		Status:     mp.GetStatus().String(),
+		ErrorCount: int32(mp.GetErrorCount()),
+		Info:       mp.GetInfo(),
+		Error:      mp.GetError(),
+	}
+	if aspect == lmtpb.LinkMargin_M_TIMING {
+		p.Offset = float64(timingMargin(ln, mp))
+		p.Unit = "UI"
+	} else {
+		p.Offset = float64(voltageMargin(ln, mp))
+		p.Unit = "V"
+	}
+	if mp.SampleCount != nil {
+		samples := int32(mp.GetSampleCount())
+		bits := math.Pow(2.0, float64(samples)/3.0)
+		p.SampleCount = &samples
+		p.Bits = &bits
+	}
+	if ber, ok := log10BER(mp); ok && mp.GetErrorCount() != 0 {
+		p.Log10Ber = &ber
+	}
+	p.Confidence = optF64(mp.GetConfidence(), mp.Confidence != nil)
+	return p
+}
+
+// newParquetLane converts a lane summary to a row.
+func newParquetLane(run parquetRun, ln *lmtpb.LinkMargin_Lane) parquetLane {
+	c := eyeCorners(ln)
+	l := parquetLane{
+		parquetRun:    run,
+		Pass:          ln.GetPass(),
+		EyeWidthUI:    optF64(ln.GetEyeWidth(), ln.EyeWidth != nil),
+		EyeHeightV:    optF64(ln.GetEyeHeight(), ln.EyeHeight != nil),
+		LeftUI:        optF64(c.left, c.hasLeft),
+		RightUI:       optF64(c.right, c.hasRight),
+		BottomV:       optF64(c.bottom, c.hasBottom),
+		TopV:          optF64(c.top, c.hasTop),
+		TimingPoints:  int32(len(ln.GetTimingMargins())),
+		VoltagePoints: int32(len(ln.GetVoltageMargins())),
+		RetimerVendor: ln.GetRetimer().GetVendor(),
+		RetimerPart:   ln.GetRetimer().GetPartNumber(),
+		RetimerFw:     ln.GetRetimer().GetFirmwareVersion(),
+		RetimerSerial: ln.GetRetimer().GetSerialNumber(),
+		ExtraInfo:     ln.GetExtraInfo(),
+	}
+	for _, mp := range append(ln.GetTimingMargins(), ln.GetVoltageMargins()...) {
+		if mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_ERROR_OUT {
+			l.ErrorOutPoints++
+		}
+	}
+	if eq := ln.GetEqualization(); eq != nil {
+		rate, dsp, usp, complete := int32(eq.GetRateGts()), int32(eq.GetDspTxPreset()), int32(eq.GetUspTxPreset()),
+			eq.GetComplete()
+		l.EqRateGTs, l.DspTxPreset, l.UspTxPreset, l.EqComplete = &rate, &dsp, &usp, &complete
+	}
+	return l
+}
+
+// writeParquet writes the rows to a Parquet file.
+func writeParquet[T any](fn string, rows []T) {
+	f, err := os.Create(fn)
+	if err != nil {
+		log.Exit(err)
+	}
+	defer f.Close()
+	w := parquet.NewGenericWriter[T](f)
+	if _, err := w.Write(rows); err != nil {
+		log.Exit(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Exit(err)
+	}
+}
+
+// ConvertToParquet converts the lmts LinkMarginTest protobuf to two Parquet files, one row per
+// margin point in pointsfn, and one row per lane in lanesfn.
+func ConvertToParquet(pointsfn string, lanesfn string) {
+	var points []parquetPoint
+	var lanes []parquetLane
+	for _, lm := range lmts.GetLinkMargin() {
+		for _, ln := range lm.GetReceiverLanes() {
+			run := newParquetRun(lm, ln)
+			for _, mp := range ln.GetTimingMargins() {
+				points = append(points, newParquetPoint(run, ln, mp, lmtpb.LinkMargin_M_TIMING))
+			}
+			for _, mp := range ln.GetVoltageMargins() {
+				points = append(points, newParquetPoint(run, ln, mp, lmtpb.LinkMargin_M_VOLTAGE))
+			}
+			lanes = append(lanes, newParquetLane(run, ln))
+		}
+	}
+	writeParquet(pointsfn, points)
+	writeParquet(lanesfn, lanes)
+}
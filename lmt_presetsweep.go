@@ -0,0 +1,409 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Preset sweep. The link is retrained with each transmitter preset forced in the Lane Equalization
+// Control of the DSP, by the LTT link retrain, and margined at each preset, for a preset-by-lane
+// eye size matrix.
+// The Link Control 2 Compliance Preset only applies in the compliance mode, so it's not written.
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/proto"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	lmtpb "lmt_go.proto"
+	"local/linktrain"
+	"local/ocpout"
+	lttpb "ltt_go.proto"
+	ocppb "ocpdiag/results_go_proto"
+	pci "pciutils"
+)
+
+const (
+	maxPreset = 10 // P0-P10
+
+	// The Link Control 3 of the Secondary PCI Express capability requests the equalization.
+	secPCIeCapID     = 0x19 // Secondary PCI Express
+	secLinkCtl3      = 0x04 // Link Control 3
+	secPerformLinkEq = 0x01 // Perform Equalization
+)
+
+// forcePreset writes the preset for both the DSP and the USP transmitters of every lane, to the
+// Lane Equalization Control of the port. It returns false if any lane doesn't read it back.
+func (p *port) forcePreset(preset uint32) bool {
+	ctl := uint8(preset<<eqUspPos | preset)
+	forced := true
+	for lane := int32(0); lane < int32(p.width); lane++ {
+		addr := p.eqAddr + eqLaneCtl + lane
+		pci.WriteByte(p.dev, addr, ctl)
+		if pci.ReadByte(p.dev, addr) != ctl {
+			forced = false
+		}
+	}
+	return forced
+}
+
+// readLaneEqCtls reads the Lane Equalization Control of every lane, to be restored after a sweep.
+func (p *port) readLaneEqCtls() []uint8 {
+	ctls := make([]uint8, p.width)
+	for lane := range ctls {
+		ctls[lane] = pci.ReadByte(p.dev, p.eqAddr+eqLaneCtl+int32(lane))
+	}
+	return ctls
+}
+
+// writeLaneEqCtls writes back the Lane Equalization Control of every lane.
+func (p *port) writeLaneEqCtls(ctls []uint8) {
+	for lane, ctl := range ctls {
+		pci.WriteByte(p.dev, p.eqAddr+eqLaneCtl+int32(lane), ctl)
+	}
+}
+
+// retrainEq requests the equalization, if the DSP has a Secondary PCI Express capability at
+// secAddr, and retrains the link by the LTT retrain. The Link Control 3 is left with the Perform
+// Equalization set, to be restored after the sweep.
+func (lt *linktest) retrainEq(secAddr int32, wait time.Duration) error {
+	if secAddr != 0 {
+		addr := secAddr + secLinkCtl3
+		pci.WriteLong(lt.dsp.dev, addr, pci.ReadLong(lt.dsp.dev, addr)|secPerformLinkEq)
+	}
+	return linktrain.ResetLink(lt.usp.dev, lt.dsp.dev, lttpb.LinkTrain_M_RETRAIN_DEFAULT, wait)
+}
+
+// sweepPresets margins the link at each preset of the preset_sweep, instead of marginLink. The
+// lanes of each preset are recorded in the preset_results, and their eye sizes are streamed as
+// OCP Measurements of the preset sweep step.
+func (lt *linktest) sweepPresets() {
+	sweep := lt.pb.GetPresetSweep()
+	presets := sweep.GetPresets()
+	if len(presets) == 0 {
+		for p := uint32(0); p <= maxPreset; p++ {
+			presets = append(presets, p)
+		}
+	}
+	wait := sweepWait(sweep.GetWaitMs())
+
+	dsp := lt.dsp
+	hwinfo := ocpout.PortHwInfoID(dsp.dev.BDFString())
+	step := lt.run.StartStep(ocpStepPrefix+"PRESET_SWEEP;"+hwinfo, "PRESET_SWEEP@"+hwinfo)
+	defer step.End(ocppb.TestRunEnd_COMPLETE)
+	if dsp.eqAddr == 0 {
+		message := lt.pb.GetMessage() + ocpout.Errorf(step, hwinfo, "pcie_lmt-preset-sweep-error",
+			"No equalization capability at gen%d. The preset sweep is skipped.", dsp.gen) + " | "
+		lt.pb.Message = &message
+		return
+	}
+	secAddr, err := dsp.getExtCapability(secPCIeCapID, "Secondary PCI Express")
+	if err != nil {
+		secAddr = 0
+		ocpout.Warningf(step, hwinfo, "%v. The link is retrained without requesting the equalization.", err)
+	}
+
+	var points []marginPoint
+	for _, preset := range presets {
+		res := &lmtpb.LinkMargin_PresetResult{Preset: preset}
+		lt.pb.PresetResults = append(lt.pb.PresetResults, res)
+		points = append(points, marginPoint{
+			tag:        fmt.Sprintf("P%d", preset),
+			stepPrefix: fmt.Sprintf("PRESET=P%d;", preset),
+			val:        preset,
+			message:    &res.Message,
+			lanes:      &res.ReceiverLanes,
+		})
+	}
+	gen, width := dsp.gen, dsp.width
+	saved := dsp.readLaneEqCtls()
+	var savedCtl3 uint32
+	if secAddr != 0 {
+		savedCtl3 = pci.ReadLong(dsp.dev, secAddr+secLinkCtl3)
+	}
+	apply := func(i int) string {
+		res := lt.pb.PresetResults[i]
+		if res.Preset > maxPreset {
+			return ocpout.Warningf(step, hwinfo, "P%d is not a preset. It is skipped.", res.Preset)
+		}
+		if res.Forced = dsp.forcePreset(res.Preset); !res.Forced {
+			return ocpout.Warningf(step, hwinfo, "P%d is not writable to the Lane Equalization Control. "+
+				"It is skipped.", res.Preset)
+		}
+		if err := lt.retrainEq(secAddr, wait); err != nil {
+			return ocpout.Errorf(step, hwinfo, "pcie_lmt-link-reset-error", "P%d: %v", res.Preset, err)
+		}
+		return ""
+	}
+	verify := func(i int, g, w uint32) string {
+		res := lt.pb.PresetResults[i]
+		if res.Gen, res.Width = g, w; g != gen || w != width {
+			return ocpout.Logf(step, ocppb.Log_ERROR, hwinfo, "P%d: The link trained to gen%dx%d, not gen%dx%d. "+
+				"It is not margined.", res.Preset, g, w, gen, width)
+		}
+		return ""
+	}
+	// Restores the presets the link trained with before the sweep, and the Link Control 3, as a
+	// Perform Equalization left set re-equalizes the link at every later retrain.
+	restore := func() error {
+		dsp.writeLaneEqCtls(saved)
+		err := lt.retrainEq(secAddr, wait)
+		if secAddr != 0 {
+			pci.WriteLong(dsp.dev, secAddr+secLinkCtl3, savedCtl3)
+		}
+		return err
+	}
+	lt.marginAtPoints(&pointSweep{step, hwinfo, "preset sweep", "preset", "pcie_lmt-preset-sweep-error"},
+		points, apply, verify, restore)
+}
+
+// sweepWait returns the wait after each retrain of a sweep, of its wait_ms.
+func sweepWait(waitMs uint32) time.Duration {
+	if waitMs == 0 {
+		return defaultRecoveryWait
+	}
+	return time.Duration(waitMs) * time.Millisecond
+}
+
+// A pointSweep is a sweep of the link over points, e.g. the presets, streamed to its OCP step.
+type pointSweep struct {
+	step    *ocpout.Step
+	hwinfo  string
+	name    string // e.g. "preset sweep", in messages.
+	key     string // The measurement metadata key of the points, e.g. "preset".
+	symptom string // The OCP Error symptom of margining a point, e.g. "pcie_lmt-preset-sweep-error".
+}
+
+// A marginPoint is a point of a sweep, e.g. the preset P3, and where its result goes.
+type marginPoint struct {
+	tag        string // e.g. "P3", prefixing the messages and naming the measurements.
+	stepPrefix string // e.g. "PRESET=P3;", prefixing the test_step_id of the receivers.
+	val        uint32 // e.g. 3, the measurement metadata value.
+	message    **string
+	lanes      *[]*lmtpb.LinkMargin_Lane
+}
+
+// marginAtPoints margins the link at each point in turn, by the spec of the link without the
+// sweeps. For each point, apply sets the link up and retrains it, and verify checks the link
+// status it trained to. They return the message streamed of why the point is not margined, or "".
+// The lanes margined are folded into the link verdict and their eye sizes streamed to the step.
+// The Target Link Speed and the Hardware Autonomous Speed/Width Disable are restored after all the
+// points, then restore sets the rest of the link back and retrains it.
+func (lt *linktest) marginAtPoints(sw *pointSweep, points []marginPoint, apply func(i int) string,
+	verify func(i int, gen, width uint32) string, restore func() error) {
+	spec := proto.Clone(lt.pb).(*lmtpb.LinkMargin)
+	spec.WidthSteps = nil
+	spec.WidthResults = nil
+	spec.SpeedSteps = nil
+	spec.SpeedResults = nil
+	spec.PresetSweep = nil
+	spec.PresetResults = nil
+	spec.ReceiverLanes = nil
+	dsp := lt.dsp
+	gen, width := dsp.gen, dsp.width
+	// Saves the Target Link Speed, and keeps the link from changing the speed and width on its own.
+	lt.prepLink()
+	for i, pt := range points {
+		message := apply(i)
+		if message == "" {
+			g, w := dsp.linkStatus()
+			message = verify(i, g, w)
+		}
+		if message != "" {
+			*pt.message = &message
+			continue
+		}
+		result, err := checkMargin(lt.usp.dev, spec, lt.run, pt.stepPrefix)
+		if err != nil {
+			message := ocpout.Errorf(sw.step, sw.hwinfo, sw.symptom, "%s: %v", pt.tag, err)
+			*pt.message = &message
+			continue
+		}
+		lt.foldPoint(result)
+		*pt.lanes = result.pb.GetReceiverLanes()
+		for _, ln := range *pt.lanes {
+			lt.outputSweepMeasurement(sw.step, strings.ToLower(pt.tag), sw.key, pt.val, ln)
+		}
+	}
+
+	lt.restoreLink()
+	if err := restore(); err != nil {
+		ocpout.Errorf(sw.step, sw.hwinfo, "pcie_lmt-link-reset-error", "Restoring the link after the %s: %v",
+			sw.name, err)
+	} else if g, w := dsp.linkStatus(); g != gen || w != width {
+		message := lt.pb.GetMessage() + ocpout.Logf(sw.step, ocppb.Log_ERROR, sw.hwinfo,
+			"After the %s, the link trained to gen%dx%d, not gen%dx%d.", sw.name, g, w, gen, width) + " | "
+		lt.pb.Message = &message
+	}
+}
+
+// foldPoint folds the lanes margined at a sweep point into the verdict of the link: each lane is
+// kept at the first point it failed at, or else at the first point it was margined at. So the link
+// fails, e.g. in the TestRunEnd and the tally, if any lane fails at any point.
+func (lt *linktest) foldPoint(pt *linktest) {
+	for i, rx := range pt.allRx {
+		if rx == nil || !rx.testReady {
+			continue
+		}
+		if lt.allRx[i] == nil {
+			folded := *rx
+			folded.lanes = slices.Clone(rx.lanes)
+			lt.allRx[i] = &folded
+			continue
+		}
+		folded := lt.allRx[i]
+		for _, ln := range rx.lanes {
+			j := slices.IndexFunc(folded.lanes, func(l *Lane) bool { return l.laneNumber == ln.laneNumber })
+			if j < 0 {
+				folded.lanes = append(folded.lanes, ln)
+			} else if folded.lanes[j].Pass && !ln.Pass {
+				folded.lanes[j] = ln
+			}
+		}
+	}
+	for _, ln := range pt.pb.GetReceiverLanes() {
+		j := slices.IndexFunc(lt.pb.ReceiverLanes, func(l *lmtpb.LinkMargin_Lane) bool {
+			return l.GetReceiver() == ln.GetReceiver() && l.GetLaneNumber() == ln.GetLaneNumber()
+		})
+		if j < 0 {
+			lt.pb.ReceiverLanes = append(lt.pb.ReceiverLanes, ln)
+		} else if lt.pb.ReceiverLanes[j].GetPass() && !ln.GetPass() {
+			lt.pb.ReceiverLanes[j] = ln
+		}
+	}
+}
+
+// outputSweepMeasurement emits the eye sizes of the lane margined at a sweep point, e.g. the
+// preset P3 with the tag "p3", and the metadata key "preset" to 3.
+func (lt *linktest) outputSweepMeasurement(step *ocpout.Step, tag, key string, val uint32, ln *lmtpb.LinkMargin_Lane) {
+	port := lt.dsp
+	if ln.GetReceiver() == lmtpb.LinkMargin_R_USP_F6 {
+		port = lt.usp
+	}
+	for _, eye := range []struct {
+		kind, unit string
+		val        *float32
+	}{{"eye_width", "UI", ln.EyeWidth}, {"eye_height", "V", ln.EyeHeight}} {
+		if eye.val == nil {
+			continue
+		}
+		metadata, _ := structpb.NewStruct(map[string]any{
+			key:        val,
+			"receiver": ln.GetReceiver().String(),
+			"lane":     ln.GetLaneNumber(),
+			"pass":     ln.GetPass(),
+		})
+		step.Measurement(&ocppb.Measurement{
+			Name: fmt.Sprintf("%s-%s-ln%02d-%s", tag,
+				strings.ToLower(strings.TrimPrefix(ln.GetReceiver().String(), "R_")), ln.GetLaneNumber(), eye.kind),
+			Unit:           eye.unit,
+			Value:          structpb.NewNumberValue(float64(*eye.val)),
+			HardwareInfoId: rxHwInfoID(port.dev, ln.GetReceiver()),
+			Metadata:       metadata,
+		})
+	}
+}
+
+// ConvertToPresetCsv writes the preset sweep results of the lmts as a preset-by-lane eye size
+// matrix: one row per link, receiver, lane and eye size, one column per preset.
+func ConvertToPresetCsv(csvfn string) {
+	writeEyeMatrix(csvfn, "P%d", func(lm *lmtpb.LinkMargin) []sweepPoint {
+		var points []sweepPoint
+		for _, res := range lm.GetPresetResults() {
+			points = append(points, sweepPoint{res.GetPreset(), res.GetReceiverLanes()})
+		}
+		return points
+	})
+}
+
+// A sweepPoint is a column of an eye size matrix: the lanes margined at a preset or a speed.
+type sweepPoint struct {
+	key   uint32
+	lanes []*lmtpb.LinkMargin_Lane
+}
+
+// writeEyeMatrix writes the sweep points of the lmts as an eye size matrix: one row per link,
+// receiver, lane and eye size, one column per sweep point key, headed by colFmt.
+func writeEyeMatrix(csvfn, colFmt string, sweepPoints func(*lmtpb.LinkMargin) []sweepPoint) {
+	type row struct {
+		usp      string
+		receiver lmtpb.LinkMargin_ReceiverEnum
+		lane     uint32
+		eye      string
+	}
+	var keys []uint32
+	var rows []row
+	cells := make(map[row]map[uint32]string)
+	for _, lm := range lmts.GetLinkMargin() {
+		for _, sp := range sweepPoints(lm) {
+			if !slices.Contains(keys, sp.key) {
+				keys = append(keys, sp.key)
+			}
+			for _, ln := range sp.lanes {
+				for eye, val := range map[string]*float32{"eye_width_ui": ln.EyeWidth, "eye_height_v": ln.EyeHeight} {
+					if val == nil {
+						continue
+					}
+					r := row{lm.GetUspBdf(), ln.GetReceiver(), ln.GetLaneNumber(), eye}
+					if cells[r] == nil {
+						cells[r] = make(map[uint32]string)
+						rows = append(rows, r)
+					}
+					cells[r][sp.key] = fmt.Sprintf("%.4f", *val)
+				}
+			}
+		}
+	}
+	slices.Sort(keys)
+	slices.SortStableFunc(rows, func(a, b row) int {
+		if c := cmp.Compare(a.usp, b.usp); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.receiver, b.receiver); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.lane, b.lane); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.eye, b.eye)
+	})
+
+	f, err := os.Create(csvfn)
+	if err != nil {
+		log.Exit(err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	header := []string{"usp_bdf", "receiver", "lane", "eye"}
+	for _, k := range keys {
+		header = append(header, fmt.Sprintf(colFmt, k))
+	}
+	w.Write(header)
+	for _, r := range rows {
+		record := []string{r.usp, r.receiver.String(), fmt.Sprint(r.lane), r.eye}
+		for _, k := range keys {
+			record = append(record, cells[r][k])
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Exit(err)
+	}
+}
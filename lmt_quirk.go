@@ -0,0 +1,119 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Per-vendor quirks for receivers that misbehave under the standard LMR procedure.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	lmtpb "lmt_go.proto"
+	pci "pciutils"
+)
+
+// knownQuirks is the quirk table compiled into the tool. It has no entries until a workaround is
+// validated on hardware; until then, quirks come from the test spec, matched after these.
+var knownQuirks = []*lmtpb.LinkMargin_Quirk{}
+
+// matchQuirk checks if a quirk applies to a receiver on the link.
+func (lt *linktest) matchQuirk(q *lmtpb.LinkMargin_Quirk, rec lmtpb.LinkMargin_ReceiverEnum) bool {
+	if len(q.GetReceiver()) != 0 && !slices.Contains(q.GetReceiver(), rec) {
+		return false
+	}
+	// The retimer identity keys only match a retimer receiver of an identified retimer.
+	if q.RetimerVendor != nil || q.RetimerPartNumber != nil {
+		i := retimerIndex(rec)
+		if i < 0 || lt.retimers[i] == nil {
+			return false
+		}
+		info := lt.retimers[i]
+		if q.RetimerVendor != nil && info.GetVendor() != q.GetRetimerVendor() {
+			return false
+		}
+		if q.RetimerPartNumber != nil && info.GetPartNumber() != q.GetRetimerPartNumber() {
+			return false
+		}
+	}
+	for _, dev := range [2]pci.Dev{lt.usp.dev, lt.dsp.dev} {
+		d := dev.GetDevInfo()
+		vidChk := q.VendorId == nil || uint32(d.VendorID) == q.GetVendorId()
+		didChk := q.DeviceId == nil || uint32(d.DeviceID) == q.GetDeviceId()
+		if vidChk && didChk {
+			return true
+		}
+	}
+	return false
+}
+
+// findQuirk merges all quirks matching a receiver on the link into one, or returns nil if none.
+func (lt *linktest) findQuirk(rec lmtpb.LinkMargin_ReceiverEnum) *lmtpb.LinkMargin_Quirk {
+	var quirk *lmtpb.LinkMargin_Quirk
+	var names []string
+	for _, q := range append(slices.Clone(knownQuirks), lt.pb.GetQuirks()...) {
+		if !lt.matchQuirk(q, rec) {
+			continue
+		}
+		if quirk == nil {
+			quirk = new(lmtpb.LinkMargin_Quirk)
+		}
+		if q.Name != nil {
+			names = append(names, q.GetName())
+		}
+		if q.SerialLanes != nil {
+			quirk.SerialLanes = q.SerialLanes
+		}
+		if q.ExtraCmdDelayUs != nil {
+			quirk.ExtraCmdDelayUs = q.ExtraCmdDelayUs
+		}
+		if q.SkipVoltage != nil {
+			quirk.SkipVoltage = q.SkipVoltage
+		}
+		if q.MaxTimingOffset != nil {
+			quirk.MaxTimingOffset = q.MaxTimingOffset
+		}
+		if q.MaxVoltageOffset != nil {
+			quirk.MaxVoltageOffset = q.MaxVoltageOffset
+		}
+	}
+	if quirk != nil {
+		name := strings.Join(names, "+")
+		quirk.Name = &name
+	}
+	return quirk
+}
+
+// quirkString describes the workarounds of a quirk for logging in the lane's extra_info.
+func quirkString(q *lmtpb.LinkMargin_Quirk) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "Quirk %q applied:", q.GetName())
+	if q.GetSerialLanes() {
+		s.WriteString(" serial_lanes;")
+	}
+	if q.ExtraCmdDelayUs != nil {
+		fmt.Fprintf(&s, " extra_cmd_delay_us=%d;", q.GetExtraCmdDelayUs())
+	}
+	if q.GetSkipVoltage() {
+		s.WriteString(" skip_voltage;")
+	}
+	if q.MaxTimingOffset != nil {
+		fmt.Fprintf(&s, " max_timing_offset=%d;", q.GetMaxTimingOffset())
+	}
+	if q.MaxVoltageOffset != nil {
+		fmt.Fprintf(&s, " max_voltage_offset=%d;", q.GetMaxVoltageOffset())
+	}
+	return s.String()
+}
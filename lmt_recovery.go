@@ -0,0 +1,92 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Link recovery after margining degrades a link, by the link training methods of the LTT.
+
+import (
+	"fmt"
+	"time"
+
+	lmtpb "lmt_go.proto"
+	"local/linktrain"
+	"local/ocpout"
+	lttpb "ltt_go.proto"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// defaultRecoveryWait is the wait after each recovery attempt, as the LTT training_wait_ms.
+const defaultRecoveryWait = 100 * time.Millisecond
+
+// recoveryMethods maps the recovery methods to the LTT link training methods.
+var recoveryMethods = map[lmtpb.LinkMargin_Recovery_MethodEnum]lttpb.LinkTrain_Method{
+	lmtpb.LinkMargin_Recovery_RM_RETRAIN:  lttpb.LinkTrain_M_RETRAIN_DEFAULT,
+	lmtpb.LinkMargin_Recovery_RM_SBR:      lttpb.LinkTrain_M_SBR,
+	lmtpb.LinkMargin_Recovery_RM_REENABLE: lttpb.LinkTrain_M_REENABLE,
+}
+
+// recoverLink retrains the link by the recovery policy, after margining the receiver r left the
+// link degraded. It returns true if both ports come back at their original width and speed.
+// The recovery event is logged in the result and the OCP stream under the receiver's step.
+func (lt *linktest) recoverLink(r *receiver) bool {
+	policy := lt.pb.GetRecovery()
+	method, ok := recoveryMethods[policy.GetMethod()]
+	if !ok {
+		return false
+	}
+	wait := defaultRecoveryWait
+	if policy.GetWaitMs() != 0 {
+		wait = time.Duration(policy.GetWaitMs()) * time.Millisecond
+	}
+	attempts := max(policy.GetMaxAttempts(), 1)
+
+	event := &lmtpb.LinkMargin_RecoveryEvent{
+		Receiver: r.rec,
+		Method:   policy.GetMethod(),
+	}
+	event.GenBefore, event.WidthBefore = lt.dsp.linkStatus()
+	for event.Attempts < attempts && !event.Recovered {
+		event.Attempts++
+		// A link not up yet within the reset is retried by the next attempt.
+		if err := linktrain.ResetLink(lt.usp.dev, lt.dsp.dev, method, wait); err != nil {
+			message := ocpout.Errorf(r.step, ocpout.PortHwInfoID(lt.dsp.dev.BDFString()), "pcie_lmt-link-reset-error",
+				"Attempt %d: %v", event.Attempts, err)
+			event.Message = &message
+		}
+		event.GenAfter, event.WidthAfter = lt.dsp.linkStatus()
+		uspGen, uspWidth := lt.usp.linkStatus()
+		event.Recovered = event.GenAfter == lt.dsp.gen && event.WidthAfter == lt.dsp.width &&
+			uspGen == lt.usp.gen && uspWidth == lt.usp.width
+	}
+	// A reset may clear the USP's link control, which must be set again for margining.
+	lt.applyLinkSettings()
+	lt.pb.RecoveryEvents = append(lt.pb.RecoveryEvents, event)
+
+	message := fmt.Sprintf("Link recovery by %s after %s in %d attempt(s): gen%dx%d to gen%dx%d.",
+		policy.GetMethod().String(), r.rec.String(), event.GetAttempts(),
+		event.GetGenBefore(), event.GetWidthBefore(), event.GetGenAfter(), event.GetWidthAfter())
+	if event.GetRecovered() {
+		ocpout.Infof(r.step, ocpout.PortHwInfoID(lt.dsp.dev.BDFString()), "%s", message)
+	} else {
+		message = message + " Failed."
+		ocpout.Logf(r.step, ocppb.Log_ERROR, ocpout.PortHwInfoID(lt.dsp.dev.BDFString()), "%s", message)
+	}
+	fullMessage := lt.pb.GetMessage() + message + " | "
+	lt.pb.Message = &fullMessage
+
+	outputHealthMeasurement(r, fmt.Sprintf("link-recovery-%s", lt.dsp.dev.BDFString()),
+		"Link Recovery Check", boolToUint32(event.GetRecovered()), 1)
+	return event.GetRecovered()
+}
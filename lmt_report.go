@@ -0,0 +1,290 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Renders an LMT result as a self-contained HTML report with inline SVG eye plots.
+// No scripts, fonts or stylesheets are fetched, so the report can be viewed on air-gapped hosts.
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	lmtpb "lmt_go.proto"
+)
+
+const (
+	eyePlotSize   = 200 // Width and height of a lane's eye plot in pixels.
+	eyePlotHalf   = 80  // Distance from the plot center to the max offset in pixels.
+	worstLog10BER = -12 // The log10 BER plotted in green. Higher BERs fade to red.
+)
+
+const reportHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PCIe LMT Report</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 16px; }
+table { border-collapse: collapse; margin: 8px 0; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: right; }
+th { background: #eee; }
+.pass { color: #080; font-weight: bold; }
+.fail { color: #c00; font-weight: bold; }
+.hops span { display: inline-block; border: 1px solid #888; border-radius: 4px; padding: 2px 6px; margin: 2px; }
+.lanes { display: flex; flex-wrap: wrap; }
+.lanes svg { margin: 2px; }
+.msg { color: #555; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>PCIe Lane Margin Test Report</h1>
+`
+
+const reportFooter = `</body>
+</html>
+`
+
+// WriteReport renders the lmts LinkMarginTest protobuf to a self-contained HTML file.
+func WriteReport(htmlfn string) {
+	var b strings.Builder
+	b.WriteString(reportHeader)
+	writeReportLegend(&b)
+	for _, lm := range lmts.GetLinkMargin() {
+		writeLinkReport(&b, lm)
+	}
+	b.WriteString(reportFooter)
+	if err := os.WriteFile(htmlfn, []byte(b.String()), 0644); err != nil {
+		log.Exit(err)
+	}
+}
+
+// writeReportLegend draws the BER color gradient used by the margin points.
+func writeReportLegend(b *strings.Builder) {
+	b.WriteString(`<p>Margin point color by BER: ` +
+		`<svg width="320" height="24" xmlns="http://www.w3.org/2000/svg">`)
+	for i := 0; i <= -worstLog10BER; i++ {
+		x := i * 24
+		fmt.Fprintf(b, `<rect x="%d" y="0" width="24" height="12" fill="%s"/>`, x,
+			berHue(float64(-i)))
+		if i%3 == 0 {
+			fmt.Fprintf(b, `<text x="%d" y="23" font-size="9">1e%d</text>`, x, -i)
+		}
+	}
+	fmt.Fprintf(b, `</svg> <svg width="12" height="12"><circle cx="6" cy="6" r="5" fill="%s"/></svg>`+
+		` NAK/unknown</p>`+"\n", nakColor)
+}
+
+// writeLinkReport writes the retimer hops, the pass/fail table and the eye plots of a link.
+func writeLinkReport(b *strings.Builder, lm *lmtpb.LinkMargin) {
+	fmt.Fprintf(b, "<h2>Link USP %s / DSP %s</h2>\n", html.EscapeString(lm.GetUspBdf()),
+		html.EscapeString(lm.GetDspBdf()))
+	if lm.VendorId != nil || lm.DeviceId != nil {
+		fmt.Fprintf(b, "<p>Vendor ID: %04x, Device ID: %04x</p>\n", lm.GetVendorId(), lm.GetDeviceId())
+	}
+
+	// Retimer hops from the DSP to the USP.
+	b.WriteString(`<p class="hops">`)
+	fmt.Fprintf(b, "<span>DSP %s</span>", html.EscapeString(lm.GetDspBdf()))
+	for _, rt := range lm.GetRetimers() {
+		fmt.Fprintf(b, " &rarr; <span>Retimer %d %s</span>", rt.GetIndex(), html.EscapeString(
+			strings.TrimSpace(strings.Join([]string{rt.GetVendor(), rt.GetPartNumber(),
+				rt.GetFirmwareVersion(), rt.GetLocation()}, " "))))
+	}
+	fmt.Fprintf(b, " &rarr; <span>USP %s</span></p>\n", html.EscapeString(lm.GetUspBdf()))
+
+	if lm.GetMessage() != "" {
+		fmt.Fprintf(b, "<p class=\"msg\">%s</p>\n", html.EscapeString(lm.GetMessage()))
+	}
+	for _, ev := range lm.GetRecoveryEvents() {
+		fmt.Fprintf(b, "<p class=\"msg\">Recovery after %s by %s: gen%dx%d to gen%dx%d, recovered=%t</p>\n",
+			ev.GetReceiver().String(), ev.GetMethod().String(), ev.GetGenBefore(), ev.GetWidthBefore(),
+			ev.GetGenAfter(), ev.GetWidthAfter(), ev.GetRecovered())
+	}
+	if len(lm.GetReceiverLanes()) == 0 {
+		return
+	}
+
+	// Pass/fail table
+	b.WriteString("<table>\n<tr><th>Receiver</th><th>Lane</th><th>Result</th>" +
+		"<th>Left[UI]</th><th>Right[UI]</th><th>Eye Width[UI]</th>" +
+		"<th>Bottom[V]</th><th>Top[V]</th><th>Eye Height[V]</th></tr>\n")
+	for _, ln := range lm.GetReceiverLanes() {
+		c := eyeCorners(ln)
+		result := `<td class="fail">FAIL</td>`
+		if ln.GetPass() {
+			result = `<td class="pass">PASS</td>`
+		}
+		fmt.Fprintf(b, "<tr><td>%s</td><td>%d</td>%s", ln.GetReceiver().String(), ln.GetLaneNumber(), result)
+		fmt.Fprintf(b, "<td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			optFloat(c.left, c.hasLeft), optFloat(c.right, c.hasRight),
+			optFloat(ln.GetEyeWidth(), ln.EyeWidth != nil),
+			optFloat(c.bottom, c.hasBottom), optFloat(c.top, c.hasTop),
+			optFloat(ln.GetEyeHeight(), ln.EyeHeight != nil))
+	}
+	b.WriteString("</table>\n")
+
+	// Eye plots, grouped by receiver in the order of the receiver number.
+	for rec := lmtpb.LinkMargin_R_DSP_A1; rec < lmtpb.LinkMargin_R_RESERVED; rec++ {
+		var lanes []*lmtpb.LinkMargin_Lane
+		for _, ln := range lm.GetReceiverLanes() {
+			if ln.GetReceiver() == rec {
+				lanes = append(lanes, ln)
+			}
+		}
+		if len(lanes) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "<h3>%s</h3>\n<div class=\"lanes\">\n", rec.String())
+		for _, ln := range lanes {
+			writeEyePlot(b, ln)
+		}
+		b.WriteString("</div>\n")
+	}
+}
+
+// corners are the max passing offsets of a lane's eye, in UI and V.
+type corners struct {
+	left, right, bottom, top             float32
+	hasLeft, hasRight, hasBottom, hasTop bool
+}
+
+// eyeCorners finds the max passing margin points of a lane.
+func eyeCorners(ln *lmtpb.LinkMargin_Lane) corners {
+	var c corners
+	for _, mp := range append(ln.GetTimingMargins(), ln.GetVoltageMargins()...) {
+		if !strings.Contains(mp.GetInfo(), cornerMaxPassing) {
+			continue
+		}
+		switch mp.GetDirection() {
+		case lmtpb.LinkMargin_Lane_MarginPoint_D_LEFT:
+			c.left, c.hasLeft = timingMargin(ln, mp), true
+		case lmtpb.LinkMargin_Lane_MarginPoint_D_RIGHT:
+			c.right, c.hasRight = timingMargin(ln, mp), true
+		case lmtpb.LinkMargin_Lane_MarginPoint_D_DOWN:
+			c.bottom, c.hasBottom = voltageMargin(ln, mp), true
+		case lmtpb.LinkMargin_Lane_MarginPoint_D_UP:
+			c.top, c.hasTop = voltageMargin(ln, mp), true
+		}
+	}
+	return c
+}
+
+// optFloat formats an optional value for the table.
+func optFloat(v float32, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%.4f", v)
+}
+
+// writeEyePlot draws a lane's eye cross plot. Timing points lie on the horizontal axis, and
+// voltage points on the vertical axis, colored by BER. The max passing corners outline the eye.
+func writeEyePlot(b *strings.Builder, ln *lmtpb.LinkMargin_Lane) {
+	const center = eyePlotSize / 2
+	param := ln.GetLaneParameter()
+	tmax := float32(param.GetMaxTimingOffset()) / 100
+	if tmax == 0 {
+		tmax = 0.5
+	}
+	vmax := float32(param.GetMaxVoltageOffset()) / 100
+	if vmax == 0 {
+		vmax = 0.5
+	}
+	x := func(m float32) float32 { return center + m/tmax*eyePlotHalf }
+	y := func(m float32) float32 { return center - m/vmax*eyePlotHalf }
+
+	border := "#c00"
+	if ln.GetPass() {
+		border = "#080"
+	}
+	fmt.Fprintf(b, `<svg width="%d" height="%d" xmlns="http://www.w3.org/2000/svg">`,
+		eyePlotSize, eyePlotSize)
+	fmt.Fprintf(b, `<rect x="0.5" y="0.5" width="%d" height="%d" fill="white" stroke="%s"/>`,
+		eyePlotSize-1, eyePlotSize-1, border)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ccc"/>`,
+		center-eyePlotHalf, center, center+eyePlotHalf, center)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ccc"/>`,
+		center, center-eyePlotHalf, center, center+eyePlotHalf)
+	fmt.Fprintf(b, `<text x="4" y="14" font-size="11">Lane %d</text>`, ln.GetLaneNumber())
+	fmt.Fprintf(b, `<text x="4" y="%d" font-size="9">&#177;%.2fUI &#177;%.2fV</text>`,
+		eyePlotSize-4, tmax, vmax)
+
+	// The eye outline through the max passing corners.
+	c := eyeCorners(ln)
+	if c.hasLeft || c.hasRight || c.hasBottom || c.hasTop {
+		fmt.Fprintf(b, `<polygon points="%.1f,%d %d,%.1f %.1f,%d %d,%.1f" fill="#cfc" fill-opacity="0.5" stroke="#080"/>`,
+			x(c.left), center, center, y(c.top), x(c.right), center, center, y(c.bottom))
+	}
+
+	for _, mp := range ln.GetTimingMargins() {
+		m := timingMargin(ln, mp)
+		writeMarginPoint(b, mp, x(m), center, fmt.Sprintf("%.4fUI", m))
+		if mp.GetDirection() == lmtpb.LinkMargin_Lane_MarginPoint_D_LR {
+			writeMarginPoint(b, mp, x(-m), center, fmt.Sprintf("%.4fUI", -m))
+		}
+	}
+	for _, mp := range ln.GetVoltageMargins() {
+		m := voltageMargin(ln, mp)
+		writeMarginPoint(b, mp, center, y(m), fmt.Sprintf("%.4fV", m))
+		if mp.GetDirection() == lmtpb.LinkMargin_Lane_MarginPoint_D_UD {
+			writeMarginPoint(b, mp, center, y(-m), fmt.Sprintf("%.4fV", -m))
+		}
+	}
+	b.WriteString("</svg>\n")
+}
+
+// writeMarginPoint draws a margin point with a tooltip.
+func writeMarginPoint(b *strings.Builder, mp *lmtpb.LinkMargin_Lane_MarginPoint, cx, cy float32,
+	offset string) {
+	tip := fmt.Sprintf("%s %d steps (%s): %s, errors=%d", mp.GetDirection().String(), mp.GetSteps(),
+		offset, mp.GetStatus().String(), mp.GetErrorCount())
+	if ber, ok := log10BER(mp); ok && mp.GetErrorCount() != 0 {
+		tip += fmt.Sprintf(", BER=1e%.1f", ber)
+	}
+	fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s</title></circle>`,
+		cx, cy, berColor(mp), html.EscapeString(tip))
+}
+
+// nakColor marks the margin points without a valid error count.
+const nakColor = "#999"
+
+// berColor maps a margin point to a color from green (BER <= 1e-12) to red (BER >= 1).
+// Without a sample count, an error-out is red, and errors under the limit are orange.
+func berColor(mp *lmtpb.LinkMargin_Lane_MarginPoint) string {
+	switch mp.GetStatus() {
+	case lmtpb.LinkMargin_Lane_MarginPoint_S_NAK, lmtpb.LinkMargin_Lane_MarginPoint_S_UNKNOWN:
+		return nakColor
+	}
+	if ber, ok := log10BER(mp); ok {
+		return berHue(ber)
+	}
+	if mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_ERROR_OUT {
+		return berHue(0)
+	}
+	if mp.GetErrorCount() != 0 {
+		return berHue(worstLog10BER / 2)
+	}
+	return berHue(worstLog10BER)
+}
+
+// berHue interpolates the hue from red at log10 BER 0 to green at worstLog10BER.
+func berHue(log10ber float64) string {
+	f := math.Min(math.Max(log10ber/worstLog10BER, 0), 1)
+	return fmt.Sprintf("hsl(%.0f,80%%,42%%)", 120*f)
+}
@@ -151,12 +151,11 @@ func ConvertToCsv(csvfn string) {
 				r[eStatus] = mp.GetStatus().String()
 				errcnt := mp.GetErrorCount()
 				r[eErrorCount] = fmt.Sprintf("%d", errcnt)
-				if mp.SampleCount != nil {
+				if ber, ok := log10BER(mp); ok {
 					r[eSamples] = fmt.Sprintf("%d", mp.GetSampleCount())
 					if errcnt == 0 {
 						r[eLog10BER] = "0"
 					} else {
-						ber := math.Log10(float64(errcnt) / math.Pow(2.0, float64(mp.GetSampleCount())/3.0))
 						r[eLog10BER] = fmt.Sprintf("%f", ber)
 					}
 				} else {
@@ -168,35 +167,18 @@ func ConvertToCsv(csvfn string) {
 				r[eTlane] = ""
 				r[eVmargin] = ""
 				r[eVlane] = ""
-				var margin float32
 				lane := link + portstart[ln.GetReceiver().Number()] + ln.GetLaneNumber()
 				if mp.PercentUi != nil {
-					// Instead of margin = mp.GetPercentUi()
-					// Recalculates the percent UI.
-					// This allows the result.pbtxt to be fixed and applied.
-					margin = float32(mp.GetSteps()) * float32(ln.GetLaneParameter().GetMaxTimingOffset()) /
-						float32(ln.GetLaneParameter().GetNumTimingSteps()*100)
-					if mp.GetDirection() == lmtpb.LinkMargin_Lane_MarginPoint_D_LEFT {
-						margin = -margin
-					}
-					r[eTmargin] = fmt.Sprintf("%f", margin)
+					r[eTmargin] = fmt.Sprintf("%f", timingMargin(ln, mp))
 					r[eTlane] = fmt.Sprintf("%d", lane)
 				} else if mp.Voltage != nil {
-					// Instead of margin = mp.GetVoltage()
-					// Recalculates the voltage, in case of some device reads false parameters.
-					// This allows the result.pbtxt to be fixed and applied.
-					margin = float32(mp.GetSteps()) * float32(ln.GetLaneParameter().GetMaxVoltageOffset()) /
-						float32(ln.GetLaneParameter().GetNumVoltageSteps()*100)
-					if mp.GetDirection() == lmtpb.LinkMargin_Lane_MarginPoint_D_DOWN {
-						margin = -margin
-					}
-					r[eVmargin] = fmt.Sprintf("%f", margin)
+					r[eVmargin] = fmt.Sprintf("%f", voltageMargin(ln, mp))
 					r[eVlane] = fmt.Sprintf("%d", lane)
 				}
 
 				// wasd vs. hjkl: gamer=pass; vi=fail
 				r[eCorner] = ""
-				if strings.Contains(mp.GetInfo(), "MAX PASSING") {
+				if strings.Contains(mp.GetInfo(), cornerMaxPassing) {
 					eye[eCorner] = "eye corners"
 					switch mp.GetDirection() {
 					case lmtpb.LinkMargin_Lane_MarginPoint_D_LEFT:
@@ -212,7 +194,7 @@ func ConvertToCsv(csvfn string) {
 						r[eCorner] = "S"
 						eye[eBottom] = r[eVmargin]
 					}
-				} else if strings.Contains(mp.GetInfo(), "MIN FAILING") {
+				} else if strings.Contains(mp.GetInfo(), cornerMinFailing) {
 					switch mp.GetDirection() {
 					case lmtpb.LinkMargin_Lane_MarginPoint_D_LEFT:
 						r[eCorner] = "H"
@@ -234,3 +216,36 @@ func ConvertToCsv(csvfn string) {
 		link = link + n
 	}
 }
+
+// timingMargin is the signed timing offset of a margin point in UI, where left is negative.
+// Instead of mp.GetPercentUi(), it recalculates the percent UI from the lane parameters.
+// This allows the result.pbtxt to be fixed and applied.
+func timingMargin(ln *lmtpb.LinkMargin_Lane, mp *lmtpb.LinkMargin_Lane_MarginPoint) float32 {
+	margin := float32(mp.GetSteps()) * float32(ln.GetLaneParameter().GetMaxTimingOffset()) /
+		float32(ln.GetLaneParameter().GetNumTimingSteps()*100)
+	if mp.GetDirection() == lmtpb.LinkMargin_Lane_MarginPoint_D_LEFT {
+		margin = -margin
+	}
+	return margin
+}
+
+// voltageMargin is the signed voltage offset of a margin point in V, where down is negative.
+// Instead of mp.GetVoltage(), it recalculates the voltage, in case of some device reads false
+// parameters. This allows the result.pbtxt to be fixed and applied.
+func voltageMargin(ln *lmtpb.LinkMargin_Lane, mp *lmtpb.LinkMargin_Lane_MarginPoint) float32 {
+	margin := float32(mp.GetSteps()) * float32(ln.GetLaneParameter().GetMaxVoltageOffset()) /
+		float32(ln.GetLaneParameter().GetNumVoltageSteps()*100)
+	if mp.GetDirection() == lmtpb.LinkMargin_Lane_MarginPoint_D_DOWN {
+		margin = -margin
+	}
+	return margin
+}
+
+// log10BER estimates the log10 of the bit error rate of a margin point from its sample count.
+// It returns false if the sample count is not reported, and -Inf if no error is seen.
+func log10BER(mp *lmtpb.LinkMargin_Lane_MarginPoint) (float64, bool) {
+	if mp.SampleCount == nil {
+		return 0, false
+	}
+	return math.Log10(float64(mp.GetErrorCount()) / math.Pow(2.0, float64(mp.GetSampleCount())/3.0)), true
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Retimer identification. A retimer has no config space of its own. It is detected through the
+// DSP's Link Status 2, and identified by the test spec and/or a sideband provider.
+
+/*
+// The Cgo import here is only for using pciutils constants.
+#include "lib/header.h"
+*/
+import (
+	"C"
+)
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	lmtpb "lmt_go.proto"
+	"local/ocpout"
+	ocppb "ocpdiag/results_go_proto"
+	pci "pciutils"
+)
+
+// maxRetimers is the max number of retimers on a link supported by LMR.
+const maxRetimers = 2
+
+// RetimerInfoProvider supplies retimer identity from a sideband, such as SMBus or a BMC.
+type RetimerInfoProvider interface {
+	// RetimerInfo returns the identity of the retimer at index on the link of the DSP, or nil if
+	// unknown.
+	RetimerInfo(dspBDF string, index uint32) (*lmtpb.LinkMargin_RetimerInfo, error)
+}
+
+// retimerInfoProvider is the optional sideband provider.
+var retimerInfoProvider RetimerInfoProvider
+
+// SetRetimerInfoProvider registers a sideband retimer identity provider before MarginLinks.
+func SetRetimerInfoProvider(p RetimerInfoProvider) {
+	retimerInfoProvider = p
+}
+
+// retimerIndex maps a retimer receiver to its retimer index, or -1 for a port receiver.
+func retimerIndex(rec lmtpb.LinkMargin_ReceiverEnum) int {
+	switch rec {
+	case lmtpb.LinkMargin_R_RTU_B2, lmtpb.LinkMargin_R_RTD_C3:
+		return 0
+	case lmtpb.LinkMargin_R_RTU_D4, lmtpb.LinkMargin_R_RTD_E5:
+		return 1
+	}
+	return -1
+}
+
+// retimersPresent reads the Retimer Presence Detected bits of the DSP.
+func (lt *linktest) retimersPresent() [maxRetimers]bool {
+	addr := lt.dsp.pcieCapOffset + C.PCI_EXP_LNKSTA2
+	val := pci.ReadWord(lt.dsp.dev, addr)
+	return [maxRetimers]bool{
+		(val & C.PCI_EXP_LINKSTA2_RETIMER) != 0,
+		(val & C.PCI_EXP_LINKSTA2_2RETIMERS) != 0,
+	}
+}
+
+// identifyRetimers looks up the identity of the retimers detected on the link.
+// The sideband provider is queried first, then the spec fields override.
+func (lt *linktest) identifyRetimers() {
+	dspBdf := lt.dsp.dev.BDFString()
+	specs := lt.pb.GetRetimers()
+	lt.pb.Retimers = nil
+	for i, present := range lt.retimersPresent() {
+		if !present {
+			continue
+		}
+		info := &lmtpb.LinkMargin_RetimerInfo{Index: uint32(i)}
+		if retimerInfoProvider != nil {
+			if ri, err := retimerInfoProvider.RetimerInfo(dspBdf, uint32(i)); err != nil {
+				ocpout.Warningf(lt.run, ocpout.PortHwInfoID(dspBdf), "Retimer %d info provider failed: %v", i, err)
+				message := lt.pb.GetMessage() + fmt.Sprintf("Retimer%d info: %s | ", i, err.Error())
+				lt.pb.Message = &message
+			} else if ri != nil {
+				proto.Merge(info, ri)
+			}
+		}
+		for _, spec := range specs {
+			if spec.GetIndex() == uint32(i) && (spec.DspBdf == nil || spec.GetDspBdf() == dspBdf) {
+				proto.Merge(info, spec)
+			}
+		}
+		info.Index = uint32(i)
+		info.DspBdf = &dspBdf
+		lt.retimers[i] = info
+		lt.pb.Retimers = append(lt.pb.Retimers, info)
+	}
+}
+
+// retimerHwInfo composes the OCP HardwareInfo of a retimer pseudo port.
+func (lt *linktest) retimerHwInfo(rec lmtpb.LinkMargin_ReceiverEnum, name string) *ocppb.HardwareInfo {
+	hwInfo := &ocppb.HardwareInfo{
+		HardwareInfoId: rxHwInfoID(lt.dsp.dev, rec),
+		Name:           name,
+	}
+	if i := retimerIndex(rec); i >= 0 && lt.retimers[i] != nil {
+		info := lt.retimers[i]
+		hwInfo.Manufacturer = info.GetVendor()
+		hwInfo.PartNumber = info.GetPartNumber()
+		hwInfo.Version = info.GetFirmwareVersion()
+		hwInfo.SerialNumber = info.GetSerialNumber()
+		hwInfo.Location = info.GetLocation()
+	}
+	return hwInfo
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Speed steps. The link is retrained with the Target Link Speed of the DSP set to each gen, by the
+// LTT link retrain, and margined at each gen, to tell the channel loss from the speed, e.g. a gen5
+// link margined at gen4 too.
+
+/*
+// The Cgo import here is only for using pciutils constants.
+#include "lib/header.h"
+*/
+import (
+	"C"
+)
+
+import (
+	"fmt"
+	"time"
+
+	lmtpb "lmt_go.proto"
+	"local/linktrain"
+	"local/ocpout"
+	lttpb "ltt_go.proto"
+	ocppb "ocpdiag/results_go_proto"
+	pci "pciutils"
+)
+
+// The Target Link Speed of the Link Control 2. The header only has it as a function-like macro.
+const lnkCtl2TargetSpeed = 0x000F
+
+// setTargetSpeed writes the Target Link Speed of the port. It takes effect at the next retrain.
+func (p *port) setTargetSpeed(gen uint32) {
+	addr := p.pcieCapOffset + C.PCI_EXP_LNKCTL2
+	val := pci.ReadWord(p.dev, addr)
+	pci.WriteWord(p.dev, addr, val&^lnkCtl2TargetSpeed|uint16(gen)&lnkCtl2TargetSpeed)
+}
+
+// retrain retrains the link by the LTT retrain.
+func (lt *linktest) retrain(wait time.Duration) error {
+	return linktrain.ResetLink(lt.usp.dev, lt.dsp.dev, lttpb.LinkTrain_M_RETRAIN_DEFAULT, wait)
+}
+
+// stepSpeeds margins the link at each gen of the speed_steps, instead of marginLink. The lanes of
+// each gen are recorded in the speed_results, and their eye sizes are streamed as OCP
+// Measurements of the speed steps step.
+func (lt *linktest) stepSpeeds() {
+	steps := lt.pb.GetSpeedSteps()
+	dsp, usp := lt.dsp, lt.usp
+	maxGen := min(dsp.maxGen, usp.maxGen)
+	gens := steps.GetGens()
+	if len(gens) == 0 {
+		for g := uint32(Speed16G); g <= min(maxGen, Speed32G); g++ {
+			gens = append(gens, g)
+		}
+	}
+	wait := sweepWait(steps.GetWaitMs())
+
+	hwinfo := ocpout.PortHwInfoID(dsp.dev.BDFString())
+	step := lt.run.StartStep(ocpStepPrefix+"SPEED_STEPS;"+hwinfo, "SPEED_STEPS@"+hwinfo)
+	defer step.End(ocppb.TestRunEnd_COMPLETE)
+
+	var points []marginPoint
+	for _, target := range gens {
+		res := &lmtpb.LinkMargin_SpeedResult{TargetGen: target}
+		lt.pb.SpeedResults = append(lt.pb.SpeedResults, res)
+		points = append(points, marginPoint{
+			tag:        fmt.Sprintf("Gen%d", target),
+			stepPrefix: fmt.Sprintf("GEN=%d;", target),
+			val:        target,
+			message:    &res.Message,
+			lanes:      &res.ReceiverLanes,
+		})
+	}
+	apply := func(i int) string {
+		target := lt.pb.SpeedResults[i].TargetGen
+		if target != Speed16G && target != Speed32G {
+			return ocpout.Warningf(step, hwinfo, "Gen%d is not gen4 nor gen5. It is skipped.", target)
+		}
+		if target > maxGen {
+			return ocpout.Warningf(step, hwinfo, "Gen%d is above the Max Link Speed gen%d of the link. "+
+				"It is skipped.", target, maxGen)
+		}
+		dsp.setTargetSpeed(target)
+		if err := lt.retrain(wait); err != nil {
+			return ocpout.Errorf(step, hwinfo, "pcie_lmt-link-reset-error", "Gen%d: %v", target, err)
+		}
+		return ""
+	}
+	verify := func(i int, g, w uint32) string {
+		res := lt.pb.SpeedResults[i]
+		if res.Gen, res.Width = g, w; g != res.TargetGen {
+			return ocpout.Logf(step, ocppb.Log_ERROR, hwinfo, "Gen%d: The link trained to gen%dx%d. "+
+				"It is not margined.", res.TargetGen, g, w)
+		}
+		return ""
+	}
+	// The Target Link Speed the link ran at before the steps is restored by the restoreLink.
+	restore := func() error { return lt.retrain(wait) }
+	lt.marginAtPoints(&pointSweep{step, hwinfo, "speed steps", "gen", "pcie_lmt-speed-steps-error"},
+		points, apply, verify, restore)
+}
+
+// ConvertToSpeedCsv writes the speed steps results of the lmts as a gen-by-lane eye size matrix:
+// one row per link, receiver, lane and eye size, one column per target gen.
+func ConvertToSpeedCsv(csvfn string) {
+	writeEyeMatrix(csvfn, "gen%d", func(lm *lmtpb.LinkMargin) []sweepPoint {
+		var points []sweepPoint
+		for _, res := range lm.GetSpeedResults() {
+			points = append(points, sweepPoint{res.GetTargetGen(), res.GetReceiverLanes()})
+		}
+		return points
+	})
+}
@@ -0,0 +1,259 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Converts an LMT result to tidy csv tables for data analysis tools, such as pandas or R.
+// Unlike the ConvertToCsv plotting layout, every row is an observation and every column a variable:
+// one row per margin point, or one row per lane in the summary. Empty cells are missing values.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	lmtpb "lmt_go.proto"
+)
+
+// A csvColumn names a column and formats its cell from a row of type T.
+type csvColumn[T any] struct {
+	name  string
+	value func(T) string
+}
+
+// tidyPoint is a row of the tidy csv.
+type tidyPoint struct {
+	lm     *lmtpb.LinkMargin
+	ln     *lmtpb.LinkMargin_Lane
+	mp     *lmtpb.LinkMargin_Lane_MarginPoint
+	aspect lmtpb.LinkMargin_MarginAspectEnum
+}
+
+// tidyLane is a row of the summary csv.
+type tidyLane struct {
+	lm *lmtpb.LinkMargin
+	ln *lmtpb.LinkMargin_Lane
+}
+
+// pointColumns are all the columns of the tidy csv, in the default order.
+var pointColumns = []csvColumn[tidyPoint]{
+	{"usp_bdf", func(p tidyPoint) string { return p.lm.GetUspBdf() }},
+	{"dsp_bdf", func(p tidyPoint) string { return p.lm.GetDspBdf() }},
+	{"receiver", func(p tidyPoint) string { return p.ln.GetReceiver().String() }},
+	{"lane", func(p tidyPoint) string { return fmt.Sprint(p.ln.GetLaneNumber()) }},
+	{"aspect", func(p tidyPoint) string { return p.aspect.String() }},
+	{"direction", func(p tidyPoint) string { return p.mp.GetDirection().String() }},
+	{"steps", func(p tidyPoint) string { return fmt.Sprint(p.mp.GetSteps()) }},
+	{"offset", func(p tidyPoint) string {
+		if p.aspect == lmtpb.LinkMargin_M_TIMING {
+			return fmt.Sprintf("%f", timingMargin(p.ln, p.mp))
+		}
+		return fmt.Sprintf("%f", voltageMargin(p.ln, p.mp))
+	}},
+	{"unit", func(p tidyPoint) string {
+		if p.aspect == lmtpb.LinkMargin_M_TIMING {
+			return "UI"
+		}
+		return "V"
+	}},
+	{"status", func(p tidyPoint) string { return p.mp.GetStatus().String() }},
+	{"error_count", func(p tidyPoint) string { return fmt.Sprint(p.mp.GetErrorCount()) }},
+	{"sample_count", func(p tidyPoint) string {
+		if p.mp.SampleCount == nil {
+			return ""
+		}
+		return fmt.Sprint(p.mp.GetSampleCount())
+	}},
+	{"bits", func(p tidyPoint) string {
+		if p.mp.SampleCount == nil {
+			return ""
+		}
+		return fmt.Sprintf("%g", math.Pow(2.0, float64(p.mp.GetSampleCount())/3.0))
+	}},
+	{"log10_ber", func(p tidyPoint) string {
+		// Missing when no error is seen, as the BER is only bounded.
+		if ber, ok := log10BER(p.mp); ok && p.mp.GetErrorCount() != 0 {
+			return fmt.Sprintf("%f", ber)
+		}
+		return ""
+	}},
+	{"confidence", func(p tidyPoint) string {
+		if p.mp.Confidence == nil {
+			return ""
+		}
+		return fmt.Sprintf("%f", p.mp.GetConfidence())
+	}},
+	{"info", func(p tidyPoint) string { return p.mp.GetInfo() }},
+	{"error", func(p tidyPoint) string { return p.mp.GetError() }},
+}
+
+// laneColumns are all the columns of the summary csv, in the default order.
+var laneColumns = []csvColumn[tidyLane]{
+	{"usp_bdf", func(l tidyLane) string { return l.lm.GetUspBdf() }},
+	{"dsp_bdf", func(l tidyLane) string { return l.lm.GetDspBdf() }},
+	{"receiver", func(l tidyLane) string { return l.ln.GetReceiver().String() }},
+	{"lane", func(l tidyLane) string { return fmt.Sprint(l.ln.GetLaneNumber()) }},
+	{"pass", func(l tidyLane) string { return fmt.Sprint(l.ln.GetPass()) }},
+	{"eye_width_ui", func(l tidyLane) string { return optFloat(l.ln.GetEyeWidth(), l.ln.EyeWidth != nil) }},
+	{"eye_height_v", func(l tidyLane) string { return optFloat(l.ln.GetEyeHeight(), l.ln.EyeHeight != nil) }},
+	{"left_ui", func(l tidyLane) string { c := eyeCorners(l.ln); return optFloat(c.left, c.hasLeft) }},
+	{"right_ui", func(l tidyLane) string { c := eyeCorners(l.ln); return optFloat(c.right, c.hasRight) }},
+	{"bottom_v", func(l tidyLane) string { c := eyeCorners(l.ln); return optFloat(c.bottom, c.hasBottom) }},
+	{"top_v", func(l tidyLane) string { c := eyeCorners(l.ln); return optFloat(c.top, c.hasTop) }},
+	{"timing_points", func(l tidyLane) string { return fmt.Sprint(len(l.ln.GetTimingMargins())) }},
+	{"voltage_points", func(l tidyLane) string { return fmt.Sprint(len(l.ln.GetVoltageMargins())) }},
+	{"error_out_points", func(l tidyLane) string {
+		n := 0
+		for _, mp := range append(l.ln.GetTimingMargins(), l.ln.GetVoltageMargins()...) {
+			if mp.GetStatus() == lmtpb.LinkMargin_Lane_MarginPoint_S_ERROR_OUT {
+				n++
+			}
+		}
+		return fmt.Sprint(n)
+	}},
+	{"retimer", func(l tidyLane) string {
+		if l.ln.Retimer == nil {
+			return ""
+		}
+		rt := l.ln.GetRetimer()
+		return strings.TrimSpace(strings.Join([]string{rt.GetVendor(), rt.GetPartNumber(),
+			rt.GetSerialNumber()}, " "))
+	}},
+	{"extra_info", func(l tidyLane) string { return l.ln.GetExtraInfo() }},
+	{"eq_rate_gts", func(l tidyLane) string { return optEq(l.ln, fmt.Sprint(l.ln.GetEqualization().GetRateGts())) }},
+	{"dsp_tx_preset", func(l tidyLane) string { return optEq(l.ln, fmt.Sprint(l.ln.GetEqualization().GetDspTxPreset())) }},
+	{"usp_tx_preset", func(l tidyLane) string { return optEq(l.ln, fmt.Sprint(l.ln.GetEqualization().GetUspTxPreset())) }},
+	{"eq_complete", func(l tidyLane) string { return optEq(l.ln, fmt.Sprint(l.ln.GetEqualization().GetComplete())) }},
+}
+
+// optEq returns the equalization value, or empty if the lane has no equalization captured.
+func optEq(ln *lmtpb.LinkMargin_Lane, v string) string {
+	if ln.Equalization == nil {
+		return ""
+	}
+	return v
+}
+
+// TidyCsvColumns lists the available columns of the tidy csv.
+func TidyCsvColumns() []string {
+	return columnNames(pointColumns)
+}
+
+// SummaryCsvColumns lists the available columns of the per-lane summary csv.
+func SummaryCsvColumns() []string {
+	return columnNames(laneColumns)
+}
+
+// CheckTidyCsvColumns checks the names of the tidy csv columns, e.g. of a flag.
+func CheckTidyCsvColumns(names []string) error {
+	_, err := selectColumns(pointColumns, names)
+	return err
+}
+
+// CheckSummaryCsvColumns checks the names of the per-lane summary csv columns, e.g. of a flag.
+func CheckSummaryCsvColumns(names []string) error {
+	_, err := selectColumns(laneColumns, names)
+	return err
+}
+
+// columnNames lists the names of the columns.
+func columnNames[T any](all []csvColumn[T]) []string {
+	names := make([]string, 0, len(all))
+	for _, c := range all {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// selectColumns picks the named columns in the given order, or all if names is empty.
+func selectColumns[T any](all []csvColumn[T], names []string) ([]csvColumn[T], error) {
+	if len(names) == 0 {
+		return all, nil
+	}
+	cols := make([]csvColumn[T], 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, c := range all {
+			if c.name == name {
+				cols = append(cols, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown csv column %q; available: %s", name,
+				strings.Join(columnNames(all), ","))
+		}
+	}
+	return cols, nil
+}
+
+// writeTable writes the header and the rows of the selected columns to a csv file.
+func writeTable[T any](csvfn string, all []csvColumn[T], names []string, rows []T) {
+	cols, err := selectColumns(all, names)
+	if err != nil {
+		log.Exit(err)
+	}
+	f, err := os.Create(csvfn)
+	if err != nil {
+		log.Exit(err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write(columnNames(cols))
+	r := make([]string, len(cols))
+	for _, row := range rows {
+		for i, c := range cols {
+			r[i] = c.value(row)
+		}
+		w.Write(r)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Exit(err)
+	}
+}
+
+// ConvertToTidyCsv converts the lmts LinkMarginTest protobuf to a csv file with one row per
+// margin point. columns selects and orders the columns; all columns if empty.
+func ConvertToTidyCsv(csvfn string, columns []string) {
+	var rows []tidyPoint
+	for _, lm := range lmts.GetLinkMargin() {
+		for _, ln := range lm.GetReceiverLanes() {
+			for _, mp := range ln.GetTimingMargins() {
+				rows = append(rows, tidyPoint{lm, ln, mp, lmtpb.LinkMargin_M_TIMING})
+			}
+			for _, mp := range ln.GetVoltageMargins() {
+				rows = append(rows, tidyPoint{lm, ln, mp, lmtpb.LinkMargin_M_VOLTAGE})
+			}
+		}
+	}
+	writeTable(csvfn, pointColumns, columns, rows)
+}
+
+// ConvertToSummaryCsv converts the lmts LinkMarginTest protobuf to a csv file with one row per
+// lane. columns selects and orders the columns; all columns if empty.
+func ConvertToSummaryCsv(csvfn string, columns []string) {
+	var rows []tidyLane
+	for _, lm := range lmts.GetLinkMargin() {
+		for _, ln := range lm.GetReceiverLanes() {
+			rows = append(rows, tidyLane{lm, ln})
+		}
+	}
+	writeTable(csvfn, laneColumns, columns, rows)
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lanemargintest
+
+// Width steps. PCIe has no standard Target Link Width, so the link is retrained with the width
+// written to a config space field described in the spec, e.g. a vendor-specific register, and
+// margined at each width. The port width is read again by the linktest of each margining, so
+// only the active lanes are margined.
+
+import (
+	"fmt"
+	"math/bits"
+
+	lmtpb "lmt_go.proto"
+	"local/ocpout"
+	ocppb "ocpdiag/results_go_proto"
+	pci "pciutils"
+)
+
+// lnkCapWidthPos is the Max Link Width position in the Link Capabilities.
+const lnkCapWidthPos = 4
+
+// findWidthControl returns the first width control of the spec matching its port device, and the
+// port.
+func (lt *linktest) findWidthControl() (*lmtpb.LinkMargin_WidthControl, *port) {
+	for _, c := range lt.pb.GetWidthSteps().GetControls() {
+		p := lt.dsp
+		if c.GetUsp() {
+			p = lt.usp
+		}
+		d := p.dev.GetDevInfo()
+		vidChk := c.VendorId == nil || uint32(d.VendorID) == c.GetVendorId()
+		didChk := c.DeviceId == nil || uint32(d.DeviceID) == c.GetDeviceId()
+		if vidChk && didChk {
+			return c, p
+		}
+	}
+	return nil, nil
+}
+
+// widthValue returns the field value of the width, shifted to the mask of the width control.
+func widthValue(c *lmtpb.LinkMargin_WidthControl, width uint32) (uint32, error) {
+	val, ok := c.GetValues()[width]
+	if !ok {
+		val = width
+	}
+	val <<= bits.TrailingZeros32(c.GetMask())
+	if val&^c.GetMask() != 0 {
+		return 0, fmt.Errorf("x%d doesn't fit the mask %#x", width, c.GetMask())
+	}
+	return val, nil
+}
+
+// writeField writes the val to the masked bits of the dword at addr of the port. It returns false
+// if the field doesn't read it back.
+func (p *port) writeField(addr int32, mask, val uint32) bool {
+	pci.WriteLong(p.dev, addr, pci.ReadLong(p.dev, addr)&^mask|val)
+	return pci.ReadLong(p.dev, addr)&mask == val
+}
+
+// stepWidths margins the link at each width of the width_steps, instead of marginLink. The lanes
+// of each width are recorded in the width_results, and their eye sizes are streamed as OCP
+// Measurements of the width steps step.
+func (lt *linktest) stepWidths() {
+	steps := lt.pb.GetWidthSteps()
+	wait := sweepWait(steps.GetWaitMs())
+
+	dsp := lt.dsp
+	hwinfo := ocpout.PortHwInfoID(dsp.dev.BDFString())
+	step := lt.run.StartStep(ocpStepPrefix+"WIDTH_STEPS;"+hwinfo, "WIDTH_STEPS@"+hwinfo)
+	defer step.End(ocppb.TestRunEnd_COMPLETE)
+	ctl, p := lt.findWidthControl()
+	if ctl == nil {
+		d := dsp.dev.GetDevInfo()
+		message := lt.pb.GetMessage() + ocpout.Warningf(step, hwinfo, "No width control matches the link "+
+			"of the DSP %04x:%04x. The width steps are skipped.", d.VendorID, d.DeviceID) + " | "
+		lt.pb.Message = &message
+		return
+	}
+	if ctl.GetAddr()%4 != 0 || ctl.GetMask() == 0 {
+		message := lt.pb.GetMessage() + ocpout.Errorf(step, hwinfo, "pcie_lmt-width-steps-error",
+			"The width control %q at %#x mask %#x is not a dword aligned field. The width steps are skipped.",
+			ctl.GetName(), ctl.GetAddr(), ctl.GetMask()) + " | "
+		lt.pb.Message = &message
+		return
+	}
+	addr := int32(ctl.GetAddr())
+	ocpout.Infof(step, ocpout.PortHwInfoID(p.dev.BDFString()), "The width control %q at %#x mask %#x applies.",
+		ctl.GetName(), ctl.GetAddr(), ctl.GetMask())
+
+	gen := dsp.gen
+	maxWidth := min(dsp.maxWidth, lt.usp.maxWidth)
+	widths := steps.GetWidths()
+	if len(widths) == 0 {
+		// Halves from the link width down to x1, by the powers of two, e.g. x12 to x8, x4, x2 and x1.
+		for w := dsp.width; ; w = 1 << (bits.Len32(w-1) - 1) {
+			widths = append(widths, w)
+			if w == 1 {
+				break
+			}
+		}
+	}
+	var points []marginPoint
+	for _, target := range widths {
+		res := &lmtpb.LinkMargin_WidthResult{TargetWidth: target}
+		lt.pb.WidthResults = append(lt.pb.WidthResults, res)
+		points = append(points, marginPoint{
+			tag:        fmt.Sprintf("x%d", target),
+			stepPrefix: fmt.Sprintf("WIDTH=x%d;", target),
+			val:        target,
+			message:    &res.Message,
+			lanes:      &res.ReceiverLanes,
+		})
+	}
+	saved := pci.ReadLong(p.dev, addr) & ctl.GetMask()
+	apply := func(i int) string {
+		target := lt.pb.WidthResults[i].TargetWidth
+		if target == 0 || target > maxWidth {
+			return ocpout.Warningf(step, hwinfo, "x%d is not within the Max Link Width x%d of the link. "+
+				"It is skipped.", target, maxWidth)
+		}
+		val, err := widthValue(ctl, target)
+		if err != nil {
+			return ocpout.Warningf(step, hwinfo, "%v. It is skipped.", err)
+		}
+		if !p.writeField(addr, ctl.GetMask(), val) {
+			return ocpout.Warningf(step, hwinfo, "x%d is not writable to the width control %q. It is skipped.",
+				target, ctl.GetName())
+		}
+		if err := lt.retrain(wait); err != nil {
+			return ocpout.Errorf(step, hwinfo, "pcie_lmt-link-reset-error", "x%d: %v", target, err)
+		}
+		return ""
+	}
+	verify := func(i int, g, w uint32) string {
+		res := lt.pb.WidthResults[i]
+		if res.Gen, res.Width = g, w; g != gen || w != res.TargetWidth {
+			return ocpout.Logf(step, ocppb.Log_ERROR, hwinfo, "x%d: The link trained to gen%dx%d, not gen%dx%d. "+
+				"It is not margined.", res.TargetWidth, g, w, gen, res.TargetWidth)
+		}
+		return ""
+	}
+	// Restores the width the link ran at before the steps.
+	restore := func() error {
+		p.writeField(addr, ctl.GetMask(), saved)
+		return lt.retrain(wait)
+	}
+	lt.marginAtPoints(&pointSweep{step, hwinfo, "width steps", "width", "pcie_lmt-width-steps-error"},
+		points, apply, verify, restore)
+}
+
+// ConvertToWidthCsv writes the width steps results of the lmts as a width-by-lane eye size
+// matrix: one row per link, receiver, lane and eye size, one column per target width.
+func ConvertToWidthCsv(csvfn string) {
+	writeEyeMatrix(csvfn, "x%d", func(lm *lmtpb.LinkMargin) []sweepPoint {
+		var points []sweepPoint
+		for _, res := range lm.GetWidthResults() {
+			points = append(points, sweepPoint{res.GetTargetWidth(), res.GetReceiverLanes()})
+		}
+		return points
+	})
+}
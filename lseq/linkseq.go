@@ -0,0 +1,202 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package linkseq chains link training and lane margin tests over the same links, e.g.
+// "SBR x50, margin, retrain x100, margin", in one OCP TestRun with one consolidated result.
+package linkseq
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	lmtpb "lmt_go.proto"
+	lmt "local/lanemargintest"
+	"local/linktrain"
+	"local/ocpout"
+	lseqpb "lseq_go.proto"
+	lttpb "ltt_go.proto"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// ReadLinkSequence reads in the sequence spec from a pbtxt.
+func ReadLinkSequence(fn string) (*lseqpb.LinkSequence, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	seq := &lseqpb.LinkSequence{}
+	opt := prototext.UnmarshalOptions{DiscardUnknown: true}
+	if err := opt.Unmarshal(data, seq); err != nil {
+		return nil, err
+	}
+	for i, step := range seq.GetSteps() {
+		if step.GetTest() == nil {
+			return nil, fmt.Errorf("step %d %q has neither link_train nor link_margin", i, step.GetName())
+		}
+	}
+	return seq, nil
+}
+
+// WriteResultPbtxt writes out the sequence with the step results to a textproto.
+func WriteResultPbtxt(seq *lseqpb.LinkSequence, outfn string) error {
+	opt := &prototext.MarshalOptions{Multiline: true, Indent: "  "}
+	data, err := opt.Marshal(seq)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outfn, data, 0600)
+}
+
+// stepName is the name of the step, defaulting to the test type, e.g. "ltt_SBR" or "lmt".
+func stepName(step *lseqpb.LinkSequence_Step) string {
+	if step.Name != nil {
+		return step.GetName()
+	}
+	if cfg := step.GetLinkTrain(); cfg != nil {
+		return "ltt_" + strings.TrimPrefix(cfg.GetMethod().String(), "M_")
+	}
+	return "lmt"
+}
+
+// selectLinks applies the link selection of the sequence to the steps not selecting their own.
+func selectLinks(seq *lseqpb.LinkSequence) {
+	for _, step := range seq.GetSteps() {
+		switch cfg := step.GetTest().(type) {
+		case *lseqpb.LinkSequence_Step_LinkTrain:
+			t := cfg.LinkTrain
+			if t.VendorId == nil && t.DeviceId == nil && len(t.GetBdf()) == 0 {
+				t.VendorId, t.DeviceId, t.Bdf = seq.VendorId, seq.DeviceId, seq.GetBdf()
+			}
+		case *lseqpb.LinkSequence_Step_LinkMargin:
+			m := cfg.LinkMargin
+			if m.VendorId == nil && m.DeviceId == nil && len(m.GetBdf()) == 0 {
+				m.VendorId, m.DeviceId, m.Bdf = seq.VendorId, seq.DeviceId, seq.GetBdf()
+			}
+		}
+	}
+}
+
+// dutInfo composes the OCP DutInfo of the links of all steps. The hardware infos shared by the
+// steps, e.g. the LTT USP and the LMT USP receiver, are listed once.
+func dutInfo(seq *lseqpb.LinkSequence) (*ocppb.DutInfo, error) {
+	dutInfo := &ocppb.DutInfo{
+		DutInfoId:     "this_pcie",
+		Name:          "pcie_lseq_dut_info",
+		SoftwareInfos: []*ocppb.SoftwareInfo{},
+	}
+	seen := make(map[string]bool)
+	for _, step := range seq.GetSteps() {
+		var info *ocppb.DutInfo
+		var err error
+		if cfg := step.GetLinkTrain(); cfg != nil {
+			info, err = linktrain.OcpDutInfo(cfg)
+		} else {
+			info, err = lmt.OcpDutInfo(step.GetLinkMargin())
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, hwInfo := range info.GetHardwareInfos() {
+			if !seen[hwInfo.GetHardwareInfoId()] {
+				seen[hwInfo.GetHardwareInfoId()] = true
+				dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
+			}
+		}
+	}
+	return dutInfo, nil
+}
+
+// marginPass tells whether no receiver lane failed the margin test.
+func marginPass(res *lmtpb.LinkMarginTest) bool {
+	for _, lm := range res.GetLinkMargin() {
+		for _, l := range lm.GetReceiverLanes() {
+			if l.Pass != nil && !l.GetPass() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// runStep runs the test of the step, with its OCP TestSteps prefixed, and fills in its result.
+func runStep(run *ocpout.Run, step *lseqpb.LinkSequence_Step, prefix string) (bool, error) {
+	if cfg := step.GetLinkTrain(); cfg != nil {
+		linktrain.OcpShare(run, prefix)
+		pass, err := linktrain.LinkTrain(proto.Clone(cfg).(*lttpb.LinkTrain))
+		if err != nil {
+			return false, err
+		}
+		step.LinkTrainResult = linktrain.Result()
+		return pass, nil
+	}
+	lmt.OcpShare(run, prefix)
+	if err := lmt.MarginLinks(proto.Clone(step.GetLinkMargin()).(*lmtpb.LinkMargin)); err != nil {
+		return false, err
+	}
+	step.LinkMarginResult = lmt.Result()
+	return marginPass(step.LinkMarginResult), nil
+}
+
+// Run runs the steps of the sequence in order over the same links, streaming one OCP TestRun to
+// w, and fills in the results of the steps. It returns whether all steps passed.
+func Run(seq *lseqpb.LinkSequence, w io.Writer, version string, cmdline string) (pass bool, _ error) {
+	run := ocpout.NewRun(w, "pcie_lseq", version, cmdline)
+	if err := run.SetParameters(seq); err != nil {
+		return false, err
+	}
+	// The problems finding the links are streamed once the OCP TestRun starts.
+	linktrain.OcpShare(run, "")
+	lmt.OcpShare(run, "")
+
+	selectLinks(seq)
+	info, err := dutInfo(seq)
+	if err != nil {
+		return false, err
+	}
+	run.Start(info)
+
+	pass = true
+	status := ocppb.TestRunEnd_COMPLETE
+	for i, step := range seq.GetSteps() {
+		name := stepName(step)
+		ocpout.Infof(run, "", "Step %d %s starts.", i, name)
+		stepPass, err := runStep(run, step, fmt.Sprintf("SEQ=%02d;", i))
+		step.Pass = &stepPass
+		pass = pass && stepPass
+		if err != nil {
+			msg := ocpout.Errorf(run, "", "pcie_lseq-step-error", "Step %d %s: %v", i, name, err)
+			step.Message = &msg
+			// The sequence didn't finish, rather than ran and failed.
+			status = ocppb.TestRunEnd_ERROR
+			break
+		}
+		if !stepPass && seq.GetStopOnFail() {
+			ocpout.Warningf(run, "", "Step %d %s failed; stopping the sequence.", i, name)
+			break
+		}
+	}
+	seq.Pass = &pass
+
+	result := ocppb.TestRunEnd_PASS
+	if !pass {
+		result = ocppb.TestRunEnd_FAIL
+	}
+	log.V(0).Infoln("Link sequence result: ", result.String())
+	return pass, run.End(status, result)
+}
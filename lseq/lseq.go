@@ -0,0 +1,83 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// PCIe link test sequence main()
+// This file handles the CLI, and the sequence spec/result pbtxt I/O.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+	lmt "local/lanemargintest"
+	"local/linkseq"
+	"local/linktrain"
+	"local/ocpsink"
+)
+
+var (
+	// The init value here is stamped by the coder. The binary builder is expected to overwrite them.
+	version   = "2024-05-17"
+	buildTime = "unknown"
+
+	getVer  = flag.Bool("version", false, "Return the version number.")
+	spec    = flag.String("spec", "", "The sequence spec .pbtxt file.")
+	result  = flag.String("result", "result.pbtxt", "The result pbtxt file name.")
+	ocpPipe = flag.String("ocp_pipe", "/dev/null", "Named pipe or file to stream the OCP Artifacts; or -, unix://, tcp://, http(s):// or rotate:// sinks.")
+	ocpBuf  = flag.Int("ocp_buffer", 0, "Bytes of OCP Artifacts buffered for a slow ocp_pipe consumer before dropping. 0 writes synchronously, blocking on the consumer.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *getVer {
+		fmt.Printf("Version:\t%s\n", version)
+		fmt.Printf("BuildTime:\t%s\n", buildTime)
+		os.Exit(0)
+	}
+
+	if *spec == "" {
+		log.Exit("Error: -spec flag missing.")
+	}
+	seq, err := linkseq.ReadLinkSequence(*spec)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	// See ocpsink for the sinks.
+	f, err := ocpsink.Open(*ocpPipe, *ocpBuf)
+	if err != nil {
+		log.Fatalf("error opening the ocp_pipe: %s %v", *ocpPipe, err)
+	}
+	lmt.SetRunInfo(version, buildTime, fmt.Sprint(os.Args))
+	// The margin checks of the link training steps run the lmt margining.
+	linktrain.SetMarginChecker(lmt.MarginChecker{})
+
+	// Runs the steps in order.
+	t := time.Now()
+	log.V(0).Infoln("Starting the link sequence: t = ", t.String())
+	_, err = linkseq.Run(seq, f, version, fmt.Sprint(os.Args))
+	log.V(0).Infoln("Link sequence done: duration = ", time.Since(t).String())
+
+	// The results of the steps run are written out even if a step stopped the sequence.
+	if werr := linkseq.WriteResultPbtxt(seq, *result); werr != nil {
+		log.Exit(werr)
+	}
+	if err != nil {
+		log.Exit(err)
+	}
+}
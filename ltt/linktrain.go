@@ -32,22 +32,22 @@ import (
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"slices"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	log "github.com/golang/glog"
-	structpb "google.golang.org/protobuf/types/known/structpb"
-	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
-	pb "ltt_go.proto"
-	pci "pciutils"
-	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	lmtpb "lmt_go.proto"
+	"local/ocpout"
+	pb "ltt_go.proto"
 	ocppb "ocpdiag/results_go_proto"
+	pci "pciutils"
 )
 
 const (
@@ -55,51 +55,46 @@ const (
 )
 
 var (
-	// ocpPipe points to the ocp artifact streaming pipe shared by all lm go routines.
-	ocpPipe     *os.File
-	ocpPipeLock sync.Mutex
-	// seqNum is a shared monotonically increasing counter for determining if any artifact is lost.
-	seqNum atomic.Int32
-	// testRunStart is the OCP starting message
-	testRunStart *ocppb.TestRunStart
-	// testRunEnd tracks the OCP TestStatus and TestResult
-	testRunEnd *ocppb.TestRunEnd
+	// ocpRun streams the OCP artifacts of all link training go routines.
+	ocpRun *ocpout.Run
+	// ocpShared is set when the OCP TestRun is started and ended by the caller.
+	ocpShared bool
+	// ocpStepPrefix prefixes the test_step_id, to be unique in a shared TestRun.
+	ocpStepPrefix string
 )
 
 // OcpInit initializes the OCP output headers.
-func OcpInit(f *os.File, name string, version string, cmdline string) {
-	ocpPipe = f
-	testRunStart = &ocppb.TestRunStart{
-		Name:        name,
-		Version:     version,
-		CommandLine: cmdline,
-	}
-	// Initialize the OCP output artifact's sequence number. Default is 0.
-	seqNum.Store(int32(0)) // 0  because of the atomicity of the counter.Add(1)
-}
-
-// outputArtifact() streams artiOut to the OcpPipe.
-func outputArtifact(artiOut *ocppb.OutputArtifact) {
-	artiOut.SequenceNumber = int32(seqNum.Add(1))
-	artiOut.Timestamp = timestamppb.Now()
-	opt := &protojson.MarshalOptions{
-		UseProtoNames:   false,
-		UseEnumNumbers:  false,
-		EmitUnpopulated: false,
-		Multiline:       false,
-		Indent:          "",
-		AllowPartial:    false,
-	}
-	if data, err := opt.Marshal(artiOut); err != nil {
-		log.Errorf("pbj.Marshal(%v) failed: %v", data, err)
-	} else {
-		ocpPipeLock.Lock()
-		ocpPipe.Write(data)
-		ocpPipe.WriteString("\n")
-		ocpPipeLock.Unlock()
+func OcpInit(f io.WriteCloser, name string, version string, cmdline string, cfg *pb.LinkTrain) {
+	ocpRun = ocpout.NewRun(f, name, version, cmdline)
+	if err := ocpRun.SetParameters(cfg); err != nil {
+		log.Exit(err)
 	}
 }
 
+// OcpShare streams the OCP artifacts of LinkTrain into a TestRun started and ended by the
+// caller, e.g. a test sequence. The step IDs are prefixed, e.g. "SEQ=01;", to be unique in the run.
+func OcpShare(run *ocpout.Run, stepPrefix string) {
+	ocpRun = run
+	ocpShared = true
+	ocpStepPrefix = stepPrefix
+}
+
+// OcpDutInfo discovers the links of the spec, and composes their OCP DutInfo for a shared TestRun.
+func OcpDutInfo(cfg *pb.LinkTrain) (*ocppb.DutInfo, error) {
+	pci.Init()
+	defer pci.Cleanup()
+
+	devs := pci.ScanDevices()
+	if !devs.Valid() {
+		return nil, fmt.Errorf("no pcie devices found")
+	}
+	links, err := getLinks(devs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ocpDutInfo(links), nil
+}
+
 // A Linktest has everything needed to test a link.
 type Linktest struct {
 	usp, dsp         pci.Dev
@@ -110,11 +105,28 @@ type Linktest struct {
 	chks             []*pb.LinkTrain_PciConfigField
 	logs             []*pb.LinkTrain_PciConfigField
 	recs             []*pb.LinkTrain_PciConfigField
+	fieldAddrs       map[*pb.LinkTrain_PciConfigField]int32 // The USP config space address per field.
 	Pass             bool
 	// PciLocation      *pci.PCIDevInfo
-	hwinfo           string // OCP hardware_info_id
-	seriesID         []string
-	seriesCnt        []int32
+	hwinfo       string                    // OCP hardware_info_id
+	step         *ocpout.Step              // The OCP TestStep of training the link.
+	series       []*ocpout.Series          // The OCP MeasurementSeries per checker, or nil if unchecked.
+	marginSeries map[string]*ocpout.Series // The OCP MeasurementSeries per margin checked lane and aspect.
+}
+
+// MarginChecker margins a link after a training, for the margin checks of the LinkTrain.
+type MarginChecker interface {
+	// CheckMargin margins the link of the USP by the test specs of the spec, and returns the
+	// result of the link with its receiver lanes.
+	CheckMargin(usp pci.Dev, spec *lmtpb.LinkMargin) (*lmtpb.LinkMargin, error)
+}
+
+// marginChecker is the optional margin checker, e.g. the lanemargintest.MarginChecker.
+var marginChecker MarginChecker
+
+// SetMarginChecker registers the margin checker before LinkTrain.
+func SetMarginChecker(m MarginChecker) {
+	marginChecker = m
 }
 
 var (
@@ -172,6 +184,71 @@ func (lt Linktest) reenable() {
 	time.Sleep(lt.waitTime)
 }
 
+// Trains the link once by the configured method.
+func (lt Linktest) train() {
+	switch lt.Cfg.GetMethod() {
+	case pb.LinkTrain_M_RETRAIN_DEFAULT:
+		lt.retrain()
+	case pb.LinkTrain_M_SBR:
+		lt.secondaryBusReset()
+	case pb.LinkTrain_M_REENABLE:
+		lt.reenable()
+	}
+}
+
+// Link up polling after a ResetLink training wait.
+const (
+	linkUpTimeout = time.Second
+	linkUpPoll    = 10 * time.Millisecond
+)
+
+// waitLinkUp polls the Link Status of the DSP until the Link Training is clear and, where the DSP
+// reports it, the Data Link Layer Link Active is set. It returns an error at the timeout.
+func (lt Linktest) waitLinkUp(timeout time.Duration) error {
+	dsp := lt.dsp
+	lnkcap := pci.ReadLong(dsp, lt.dspPCIeCapOffset+C.PCI_EXP_LNKCAP)
+	dllaCapable := (lnkcap & C.PCI_EXP_LNKCAP_DLLA) != 0
+	deadline := time.Now().Add(timeout)
+	for {
+		lnksta := pci.ReadWord(dsp, lt.dspPCIeCapOffset+C.PCI_EXP_LNKSTA)
+		training := (lnksta & C.PCI_EXP_LNKSTA_TRAIN) != 0
+		active := !dllaCapable || (lnksta&C.PCI_EXP_LNKSTA_DL_ACT) != 0
+		if !training && active {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: link not up %v after training: PCI_EXP_LNKSTA=0x%04x",
+				dsp.BDFString(), timeout, lnksta)
+		}
+		time.Sleep(linkUpPoll)
+	}
+}
+
+// ResetLink trains the link between the usp and the dsp once by the method, and waits for the
+// link to come up: after the wait, the DSP Link Status is polled up to linkUpTimeout. It allows
+// other tests, e.g. the LMT, to recover a degraded link.
+func ResetLink(usp, dsp pci.Dev, method pb.LinkTrain_Method, wait time.Duration) error {
+	capOffset, err := getPCIeCapOffset(dsp)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dsp.BDFString(), err)
+	}
+	uspBdf := usp.BDFString()
+	dspBdf := dsp.BDFString()
+	lt := Linktest{
+		usp:              usp,
+		dsp:              dsp,
+		dspPCIeCapOffset: capOffset,
+		waitTime:         wait,
+		Cfg: &pb.LinkTrain{
+			UspBdf: &uspBdf,
+			DspBdf: &dspBdf,
+			Method: method,
+		},
+	}
+	lt.train()
+	return lt.waitLinkUp(linkUpTimeout)
+}
+
 // getPCIeCapOffset scans the PCI capability linked list for PCIe CAP.
 // Refers to google3/third_party/pciutils/ls-caps.c;rcl=357071835;l=1675
 var getPCIeCapOffset = func(dev pci.Dev) (int32, error) {
@@ -198,6 +275,70 @@ var getPCIeCapOffset = func(dev pci.Dev) (int32, error) {
 	return 0, fmt.Errorf("PCIe capability header not found")
 }
 
+// getExtCapOffset scans the PCI extended capability linked list for a capability ID.
+// Refers to pciutils/ls-ecaps.c
+func getExtCapOffset(dev pci.Dev, capID int32) (int32, error) {
+	const (
+		configSpace     = int32(0x1000)
+		capabilityStart = int32(0x100)
+		capabilityMask  = int32(0x00FF)
+		addrMask        = int32(0x0FFC)
+		nextPos         = int(20)
+	)
+	var been [configSpace]bool
+	for addr := capabilityStart; addr != 0; {
+		hdr := int32(pci.ReadLong(dev, addr))
+		if (hdr & capabilityMask) == capID {
+			return addr, nil
+		}
+		been[addr] = true
+		addr = (hdr >> nextPos) & addrMask
+		if been[addr] {
+			return 0, fmt.Errorf("Capability chain loops at 0x%x", addr)
+		}
+	}
+	return 0, fmt.Errorf("Extended capability 0x%x header not found", capID)
+}
+
+// extCapIDs are the extended capability IDs of the capabilities a field can be relative to.
+var extCapIDs = map[pb.LinkTrain_PciConfigField_CapabilityEnum]int32{
+	pb.LinkTrain_PciConfigField_CAP_AER:     C.PCI_EXT_CAP_ID_AER,
+	pb.LinkTrain_PciConfigField_CAP_LMR:     C.PCI_EXT_CAP_ID_LMR,
+	pb.LinkTrain_PciConfigField_CAP_PL_16GT: C.PCI_EXT_CAP_ID_16GT,
+	pb.LinkTrain_PciConfigField_CAP_PL_32GT: C.PCI_EXT_CAP_ID_32GT,
+}
+
+// getCapOffset returns the offset of the capability on the device, or 0 for CAP_NONE.
+func getCapOffset(dev pci.Dev, capability pb.LinkTrain_PciConfigField_CapabilityEnum) (int32, error) {
+	switch capability {
+	case pb.LinkTrain_PciConfigField_CAP_NONE:
+		return 0, nil
+	case pb.LinkTrain_PciConfigField_CAP_PCIE:
+		return getPCIeCapOffset(dev)
+	}
+	capID, ok := extCapIDs[capability]
+	if !ok {
+		return 0, fmt.Errorf("Unknown capability %s", capability.String())
+	}
+	return getExtCapOffset(dev, capID)
+}
+
+// resolveFields finds the config space address of each field on the USP. A field relative to a
+// capability the USP doesn't have is set to S_ERROR, so it's neither checked, logged nor restored.
+func (lt *Linktest) resolveFields() {
+	lt.fieldAddrs = make(map[*pb.LinkTrain_PciConfigField]int32)
+	for _, f := range lt.Cfg.GetField() {
+		offset, err := getCapOffset(lt.usp, f.GetCapability())
+		if err != nil {
+			ocpout.Errorf(ocpRun, ocpout.PortHwInfoID(lt.usp.BDFString()), "ltt-field-cap-missing",
+				"The %s field is skipped: %s: %v", f.GetName(), f.GetCapability().String(), err)
+			f.State = pb.LinkTrain_PciConfigField_S_ERROR
+			continue
+		}
+		lt.fieldAddrs[f] = offset + int32(f.GetAddr())
+	}
+}
+
 // ReadLinkTrainProto reads in the linktrain.proto in text format.
 func ReadLinkTrainProto(fn string) (*pb.LinkTrain, error) {
 	cfgfn = fn
@@ -242,7 +383,8 @@ func getLinks(devs pci.Dev, cfg *pb.LinkTrain) ([]*Linktest, error) {
 			if offset, err := getPCIeCapOffset(dev); err != nil {
 				// If there's any error getting the PCIe capability offset, the device
 				// is to be excluded from testing.
-				log.Warningf("A matching device failed to get the PCIe Capability offset: %v. Error: %s", dev, err.Error())
+				ocpout.Warningf(ocpRun, ocpout.PortHwInfoID(dev.BDFString()),
+					"A matching device failed to get the PCIe Capability offset: %v", err)
 				continue
 			} else {
 				portType := pci.ReadWord(dev, offset+C.PCI_EXP_FLAGS) & C.PCI_EXP_FLAGS_TYPE
@@ -266,6 +408,7 @@ func getLinks(devs pci.Dev, cfg *pb.LinkTrain) ([]*Linktest, error) {
 			lt.dsp = dsp
 			lt.dspPCIeCapOffset = offset
 			lt.Cfg = proto.Clone(cfg).(*pb.LinkTrain)
+			lt.resolveFields()
 			lt.chks = filterFields(lt.Cfg.GetField(), pb.LinkTrain_PciConfigField_S_CHECK)
 			lt.logs = filterFields(lt.Cfg.GetField(), pb.LinkTrain_PciConfigField_S_LOG)
 			lt.recs = filterFields(lt.Cfg.GetField(), pb.LinkTrain_PciConfigField_S_RECOVER)
@@ -297,44 +440,31 @@ func getLinks(devs pci.Dev, cfg *pb.LinkTrain) ([]*Linktest, error) {
 
 // Checks config registers of an USP against the proto spec.
 func (lt *Linktest) check() bool {
-	usp := lt.usp
 	chks := lt.chks
 	pass := true
 
 	for i, f := range chks {
-		var v uint32
+		v := lt.readField(f)
 		var valStr string
 		switch f.GetSize() {
 		case pb.LinkTrain_PciConfigField_UINT8:
-			v = uint32(pci.ReadByte(usp, int32(f.GetAddr())))
 			valStr = fmt.Sprintf("%2x", v)
 		case pb.LinkTrain_PciConfigField_UINT16:
-			v = uint32(pci.ReadWord(usp, int32(f.GetAddr())))
 			valStr = fmt.Sprintf("%4x", v)
 		case pb.LinkTrain_PciConfigField_UINT32:
-			v = uint32(pci.ReadLong(usp, int32(f.GetAddr())))
 			valStr = fmt.Sprintf("%8x", v)
+		case pb.LinkTrain_PciConfigField_UINT64:
+			valStr = fmt.Sprintf("%16x", v)
 		}
 
-		mSeries := &ocppb.MeasurementSeriesElement{
-			Index:               lt.seriesCnt[i],
-			MeasurementSeriesId: lt.seriesID[i],
-			Value:               structpb.NewStringValue(valStr),
-			Timestamp:           timestamppb.Now(),
+		if lt.series[i] != nil {
+			lt.series[i].Add(structpb.NewStringValue(valStr))
 		}
-		stepArti := &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_MeasurementSeriesElement{MeasurementSeriesElement: mSeries},
-			TestStepId: lt.hwinfo,
-		}
-		outArti := &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-		}
-		outputArtifact(outArti)
-		lt.seriesCnt[i]++
 
 		if f.Expected == nil {
 			if f.GetState() != pb.LinkTrain_PciConfigField_S_ERROR {
-				log.Errorf("The %s checking does not have an expected value.", f.GetName())
+				ocpout.Errorf(lt.step, lt.hwinfo, "ltt-check-spec-error", "The %s checking does not have an expected value.",
+					f.GetName())
 			}
 			f.State = pb.LinkTrain_PciConfigField_S_ERROR
 			pass = false
@@ -358,18 +488,8 @@ func (lt *Linktest) check() bool {
 
 // Logs config register values of an USP according to the proto spec.
 func (lt *Linktest) log() {
-	usp := lt.usp
 	for _, f := range lt.logs {
-		var v uint32
-		switch f.GetSize() {
-		case pb.LinkTrain_PciConfigField_UINT8:
-			v = uint32(pci.ReadByte(usp, int32(f.GetAddr())))
-		case pb.LinkTrain_PciConfigField_UINT16:
-			v = uint32(pci.ReadWord(usp, int32(f.GetAddr())))
-		case pb.LinkTrain_PciConfigField_UINT32:
-			v = uint32(pci.ReadLong(usp, int32(f.GetAddr())))
-		}
-		v = v & f.GetMask()
+		v := lt.readField(f) & f.GetMask()
 		f.Val = &v
 		f.State = pb.LinkTrain_PciConfigField_S_LOGGED
 	}
@@ -377,45 +497,52 @@ func (lt *Linktest) log() {
 
 // record records config register values of an USP according to the proto spec.
 func (lt *Linktest) record() {
-	usp := lt.usp
 	for _, f := range lt.recs {
-		var v uint32
-		switch f.GetSize() {
-		case pb.LinkTrain_PciConfigField_UINT8:
-			v = uint32(pci.ReadByte(usp, int32(f.GetAddr())))
-		case pb.LinkTrain_PciConfigField_UINT16:
-			v = uint32(pci.ReadWord(usp, int32(f.GetAddr())))
-		case pb.LinkTrain_PciConfigField_UINT32:
-			v = uint32(pci.ReadLong(usp, int32(f.GetAddr())))
-		}
-		v = v & f.GetMask()
+		v := lt.readField(f) & f.GetMask()
 		f.Val = &v
 	}
 }
 
 // restore restores the recorded config register values.
 func (lt *Linktest) restore() {
-	usp := lt.usp
 	for _, f := range lt.recs {
-		var v uint32
 		// Conducts read-modify-write
-		switch f.GetSize() {
-		case pb.LinkTrain_PciConfigField_UINT8:
-			v = uint32(pci.ReadByte(usp, int32(f.GetAddr()))) & (0xff ^ f.GetMask())
-		case pb.LinkTrain_PciConfigField_UINT16:
-			v = uint32(pci.ReadWord(usp, int32(f.GetAddr()))) & (0xffff ^ f.GetMask())
-		case pb.LinkTrain_PciConfigField_UINT32:
-			v = uint32(pci.ReadLong(usp, int32(f.GetAddr()))) & (0xffffffff ^ f.GetMask())
-		}
+		v := lt.readField(f) &^ f.GetMask()
 		v = v | (f.GetVal() & f.GetMask())
-		switch f.GetSize() {
-		case pb.LinkTrain_PciConfigField_UINT8:
-			pci.WriteByte(usp, int32(f.GetAddr()), uint8(v))
-		case pb.LinkTrain_PciConfigField_UINT16:
-			pci.WriteWord(usp, int32(f.GetAddr()), uint16(v))
-		case pb.LinkTrain_PciConfigField_UINT32:
-			pci.WriteLong(usp, int32(f.GetAddr()), uint32(v))
-		}
+		lt.writeField(f, v)
+	}
+}
+
+// readField reads a config register of the USP at the field's address, by the field size.
+func (lt *Linktest) readField(f *pb.LinkTrain_PciConfigField) uint64 {
+	addr := lt.fieldAddrs[f]
+	switch f.GetSize() {
+	case pb.LinkTrain_PciConfigField_UINT8:
+		return uint64(pci.ReadByte(lt.usp, addr))
+	case pb.LinkTrain_PciConfigField_UINT16:
+		return uint64(pci.ReadWord(lt.usp, addr))
+	case pb.LinkTrain_PciConfigField_UINT32:
+		return uint64(pci.ReadLong(lt.usp, addr))
+	case pb.LinkTrain_PciConfigField_UINT64:
+		// The config space is accessed by dwords, the low dword first.
+		return uint64(pci.ReadLong(lt.usp, addr)) | uint64(pci.ReadLong(lt.usp, addr+4))<<32
+	}
+	return 0
+}
+
+// writeField writes a config register of the USP at the field's address, by the field size.
+func (lt *Linktest) writeField(f *pb.LinkTrain_PciConfigField, v uint64) {
+	addr := lt.fieldAddrs[f]
+	switch f.GetSize() {
+	case pb.LinkTrain_PciConfigField_UINT8:
+		pci.WriteByte(lt.usp, addr, uint8(v))
+	case pb.LinkTrain_PciConfigField_UINT16:
+		pci.WriteWord(lt.usp, addr, uint16(v))
+	case pb.LinkTrain_PciConfigField_UINT32:
+		pci.WriteLong(lt.usp, addr, uint32(v))
+	case pb.LinkTrain_PciConfigField_UINT64:
+		pci.WriteLong(lt.usp, addr, uint32(v))
+		pci.WriteLong(lt.usp, addr+4, uint32(v>>32))
 	}
 }
 
@@ -428,30 +555,19 @@ func trainLoop(lt *Linktest) {
 	lt.record()
 
 	// OCP TestStepStart
-	lt.hwinfo = lt.usp.BDFString()
-	stepStart := &ocppb.TestStepStart{
-		Name: strings.TrimPrefix(cfg.GetMethod().String(), "M_") + "@" + lt.hwinfo,
-	}
-	stepArti := &ocppb.TestStepArtifact{
-		Artifact:   &ocppb.TestStepArtifact_TestStepStart{TestStepStart: stepStart},
-		TestStepId: lt.hwinfo,
-	}
-	outArti := &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-	}
-	outputArtifact(outArti)
+	lt.hwinfo = ocpout.ReceiverHwInfoID(lt.usp.BDFString(), "USP_F6")
+	lt.step = ocpRun.StartStep(ocpStepPrefix+lt.hwinfo, strings.TrimPrefix(cfg.GetMethod().String(), "M_")+"@"+lt.hwinfo)
 
 	// Starts one MeasurementSeries per checker.
+	lt.series = make([]*ocpout.Series, len(lt.chks))
 	for i, f := range lt.chks {
-		lt.seriesCnt = append(lt.seriesCnt, 0)
-
 		if f.Expected == nil {
 			if f.GetState() != pb.LinkTrain_PciConfigField_S_ERROR {
-				log.Errorf("The %s checking does not have an expected value.", f.GetName())
+				ocpout.Errorf(lt.step, lt.hwinfo, "ltt-check-spec-error", "The %s checking does not have an expected value.",
+					f.GetName())
 			}
 			state := pb.LinkTrain_PciConfigField_S_ERROR
 			f.State = state
-			lt.seriesID = append(lt.seriesID, "")
 			continue
 		}
 
@@ -467,28 +583,34 @@ func trainLoop(lt *Linktest) {
 		case pb.LinkTrain_PciConfigField_UINT32:
 			seriesFmt = "%s:%04X.%s==%08x:%08x"
 			valFmt = "%08x"
+		case pb.LinkTrain_PciConfigField_UINT64:
+			seriesFmt = "%s:%04X.%s==%016x:%016x"
+			valFmt = "%016x"
 		}
-		lt.seriesID = append(lt.seriesID,
-			fmt.Sprintf(seriesFmt, f.GetName(), f.GetAddr(), f.GetSize().String(), f.GetExpected(), f.GetMask()))
+		// A capability relative field is identified by its address on the USP.
+		seriesID := fmt.Sprintf(seriesFmt, f.GetName(), lt.fieldAddrs[f], f.GetSize().String(), f.GetExpected(), f.GetMask())
 		val := &ocppb.Validator{
-			Name:  lt.seriesID[i],
+			Name:  seriesID,
 			Type:  ocppb.Validator_EQUAL,
 			Value: structpb.NewStringValue(fmt.Sprintf(valFmt, (f.GetMask() & f.GetExpected()))),
 		}
 		mSeries := &ocppb.MeasurementSeriesStart{
-			Name:                strings.ToLower(fmt.Sprintf("%s-%04x-"+valFmt, f.GetName(), f.GetAddr(), f.GetExpected())),
-			MeasurementSeriesId: lt.seriesID[i],
+			Name:                strings.ToLower(fmt.Sprintf("%s-%04x-"+valFmt, f.GetName(), lt.fieldAddrs[f], f.GetExpected())),
+			MeasurementSeriesId: seriesID,
 			HardwareInfoId:      lt.hwinfo,
 			Validators:          []*ocppb.Validator{val},
 		}
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_MeasurementSeriesStart{MeasurementSeriesStart: mSeries},
-			TestStepId: lt.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-		}
-		outputArtifact(outArti)
+		lt.series[i] = lt.step.StartSeries(mSeries)
+	}
+
+	lt.marginSeries = make(map[string]*ocpout.Series)
+	marginEvery := int(cfg.GetMarginEvery())
+	if marginEvery > 0 && marginChecker == nil {
+		ocpout.Warningf(lt.step, lt.hwinfo, "No margin checker is linked in. The margin_every is ignored.")
+		marginEvery = 0
+	} else if marginEvery > 0 && len(cfg.GetMarginSpec().GetTestSpecs()) == 0 {
+		ocpout.Warningf(lt.step, lt.hwinfo, "The margin_spec has no test_specs. The margin_every is ignored.")
+		marginEvery = 0
 	}
 
 	diag := &ocppb.Diagnosis{
@@ -502,32 +624,18 @@ func trainLoop(lt *Linktest) {
 		failCnt := cfg.GetFailCount() + 1
 		cfg.FailCount = &failCnt
 		lt.Pass = false
-		log.Warningf("Initial checking failed. %v", lt)
+		ocpout.Warningf(lt.step, lt.hwinfo, "Initial checking failed. %v", lt)
 
 		diag.Type = ocppb.Diagnosis_FAIL
 		diag.Verdict = "ltt-initial-checking-failed"
 		diag.Message = fmt.Sprintf("%s link failed LTT initial checking: pass_count=%d; fail_count=%d",
-			lt.hwinfo, cfg.GetPassCount(), cfg.GetFailCount())
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_Diagnosis{Diagnosis: diag},
-			TestStepId: lt.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-		}
-		outputArtifact(outArti)
+			lt.usp.BDFString(), cfg.GetPassCount(), cfg.GetFailCount())
+		lt.step.Diagnosis(diag)
 		return
 	}
 
 	for i := 0; i < itr; i++ {
-		switch lt.Cfg.GetMethod() {
-		case pb.LinkTrain_M_RETRAIN_DEFAULT:
-			lt.retrain()
-		case pb.LinkTrain_M_SBR:
-			lt.secondaryBusReset()
-		case pb.LinkTrain_M_REENABLE:
-			lt.reenable()
-		}
+		lt.train()
 		if !lt.check() {
 			// Always logs the first failure.
 			if cfg.GetFailCount() == 0 {
@@ -544,6 +652,9 @@ func trainLoop(lt *Linktest) {
 			passCnt := cfg.GetPassCount() + 1
 			cfg.PassCount = &passCnt
 		}
+		if marginEvery > 0 && (i+1)%marginEvery == 0 {
+			lt.checkMargin(i + 1)
+		}
 		log.V(1).Infoln(fmt.Sprintf("BDF:%s: Iteration:%d; Pass:%d; Fail:%d",
 			cfg.GetUspBdf(), i, cfg.GetPassCount(), cfg.GetFailCount()))
 	}
@@ -555,109 +666,127 @@ func trainLoop(lt *Linktest) {
 		diag.Type = ocppb.Diagnosis_PASS
 		diag.Verdict = "ltt-passed"
 		diag.Message = fmt.Sprintf("%s link passed LTT: pass_count=%d; fail_count=%d",
-			lt.hwinfo, cfg.GetPassCount(), cfg.GetFailCount())
+			lt.usp.BDFString(), cfg.GetPassCount(), cfg.GetFailCount())
 	} else {
 		diag.Type = ocppb.Diagnosis_FAIL
 		diag.Verdict = "ltt-failed"
 		diag.Message = fmt.Sprintf("%s link failed LTT: pass_count=%d; fail_count=%d",
-			lt.hwinfo, cfg.GetPassCount(), cfg.GetFailCount())
+			lt.usp.BDFString(), cfg.GetPassCount(), cfg.GetFailCount())
 	}
 
-	stepArti = &ocppb.TestStepArtifact{
-		Artifact:   &ocppb.TestStepArtifact_Diagnosis{Diagnosis: diag},
-		TestStepId: lt.hwinfo,
-	}
-	outArti = &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-	}
-	outputArtifact(outArti)
+	lt.step.Diagnosis(diag)
 
 	// Restores the recorded fields.
 	lt.restore()
 
-	// Ends MeasurementSeries per checker.
-	for i, id := range lt.seriesID {
-		mSeries := &ocppb.MeasurementSeriesEnd{
-			MeasurementSeriesId: id,
-			TotalCount:          int32(lt.seriesCnt[i]),
+	// Ends MeasurementSeries per checker, and per margin checked lane and aspect.
+	for _, series := range lt.series {
+		if series != nil {
+			series.End()
 		}
-		stepArti = &ocppb.TestStepArtifact{
-			Artifact:   &ocppb.TestStepArtifact_MeasurementSeriesEnd{MeasurementSeriesEnd: mSeries},
-			TestStepId: lt.hwinfo,
-		}
-		outArti = &ocppb.OutputArtifact{
-			Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-		}
-		outputArtifact(outArti)
 	}
-
-	// OCP TestStepEnd
-	stepEnd := &ocppb.TestStepEnd{
-		Status: ocppb.TestRunEnd_COMPLETE,
+	ids := make([]string, 0, len(lt.marginSeries))
+	for id := range lt.marginSeries {
+		ids = append(ids, id)
 	}
-	stepArti = &ocppb.TestStepArtifact{
-		Artifact:   &ocppb.TestStepArtifact_TestStepEnd{TestStepEnd: stepEnd},
-		TestStepId: lt.hwinfo,
+	slices.Sort(ids)
+	for _, id := range ids {
+		lt.marginSeries[id].End()
 	}
-	outArti = &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
-	}
-	outputArtifact(outArti)
+
+	// OCP TestStepEnd
+	lt.step.End(ocppb.TestRunEnd_COMPLETE)
 }
 
-// ocpTestRunStart starts an OCP TestRun
-func ocpTestRunStart(cfg *pb.LinkTrain) {
-	if testRunStart == nil {
-		if f, err := os.OpenFile("/dev/null", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777); err != nil {
-			log.Fatalf("error opening /dev/null : %v", err)
-		} else {
-			OcpInit(f, fmt.Sprintf("pcie_ltt_%s", strings.TrimPrefix(cfg.GetMethod().String(), "M_")), "undefined", fmt.Sprint(os.Args))
-		}
-	}
+// checkMargin margins the link after the iteration, and records the check in the result. The eye
+// margins are streamed in one MeasurementSeries per receiver lane and aspect, or the pass of the
+// lane if no eye was measured.
+func (lt *Linktest) checkMargin(iteration int) {
+	chk := &pb.LinkTrain_MarginCheck{Iteration: int32(iteration)}
+	defer func() { lt.Cfg.MarginChecks = append(lt.Cfg.MarginChecks, chk) }()
 
-	ver := &ocppb.SchemaVersion{
-		Major: 2,
-		Minor: 0,
+	res, err := marginChecker.CheckMargin(lt.usp, lt.Cfg.GetMarginSpec())
+	chk.Result = res
+	if err != nil {
+		message := ocpout.Errorf(lt.step, lt.hwinfo, "ltt-margin-check-error", "Margin check after iteration %d: %v",
+			iteration, err)
+		chk.Message = &message
+		return
+	}
+	chk.Pass = true
+	for _, ln := range res.GetReceiverLanes() {
+		if !ln.GetPass() {
+			chk.Pass = false
+		}
+		if ln.EyeWidth != nil {
+			lt.addMargin(iteration, ln, "eye_width", "UI", ln.GetEyeWidth())
+		}
+		if ln.EyeHeight != nil {
+			lt.addMargin(iteration, ln, "eye_height", "V", ln.GetEyeHeight())
+		}
+		// A target_offset check measures no eye, only whether the lane passes at the offset.
+		if ln.EyeWidth == nil && ln.EyeHeight == nil {
+			pass := float32(0)
+			if ln.GetPass() {
+				pass = 1
+			}
+			lt.addMargin(iteration, ln, "pass", "", pass)
+		}
 	}
-	artiOut := &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_SchemaVersion{SchemaVersion: ver},
+	if !chk.Pass {
+		ocpout.Warningf(lt.step, lt.hwinfo, "Margin check after iteration %d failed.", iteration)
 	}
-	outputArtifact(artiOut)
+}
+
+// addMargin adds an eye margin of the lane to its MeasurementSeries, started at the first check.
+func (lt *Linktest) addMargin(iteration int, ln *lmtpb.LinkMargin_Lane, kind string, unit string, v float32) {
+	rec := strings.TrimPrefix(ln.GetReceiver().String(), "R_")
+	id := fmt.Sprintf("%s;MARGIN=%s;LN=%02d;%s", lt.step.ID(), rec, ln.GetLaneNumber(), kind)
+	series, ok := lt.marginSeries[id]
+	if !ok {
+		metadata, _ := structpb.NewStruct(map[string]any{
+			"receiver": rec,
+			"lane":     ln.GetLaneNumber(),
+		})
+		series = lt.step.StartSeries(&ocppb.MeasurementSeriesStart{
+			Name:                strings.ToLower(fmt.Sprintf("margin-%s-ln%02d-%s", rec, ln.GetLaneNumber(), kind)),
+			Unit:                unit,
+			MeasurementSeriesId: id,
+			HardwareInfoId:      lt.hwinfo,
+			Metadata:            metadata,
+		})
+		lt.marginSeries[id] = series
+	}
+	metadata, _ := structpb.NewStruct(map[string]any{
+		"iteration": iteration,
+		"pass":      ln.GetPass(),
+	})
+	series.AddWithMetadata(structpb.NewNumberValue(float64(v)), metadata)
+}
 
+// ocpDutInfo composes the OCP DutInfo of the links.
+func ocpDutInfo(links []*Linktest) *ocppb.DutInfo {
 	dutInfo := &ocppb.DutInfo{
 		DutInfoId:     "this_pcie",
-		Name:          "pcie_lmt_dut_info",
+		Name:          "pcie_ltt_dut_info",
 		SoftwareInfos: []*ocppb.SoftwareInfo{},
 	}
 
 	var hwInfo *ocppb.HardwareInfo
-	for _, lt := range Lts {
+	for _, lt := range links {
 		hwInfo = &ocppb.HardwareInfo{
-			HardwareInfoId: lt.dsp.BDFString(),
+			HardwareInfoId: ocpout.ReceiverHwInfoID(lt.dsp.BDFString(), "DSP_A1"),
 			Name:           "DSP",
 		}
 		dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
 
 		hwInfo = &ocppb.HardwareInfo{
-			HardwareInfoId: lt.usp.BDFString(),
+			HardwareInfoId: ocpout.ReceiverHwInfoID(lt.usp.BDFString(), "USP_F6"),
 			Name:           "USP",
 		}
 		dutInfo.HardwareInfos = append(dutInfo.HardwareInfos, hwInfo)
 	}
-
-	testRunStart.DutInfo = dutInfo
-	runArti := &ocppb.TestRunArtifact{
-		Artifact: &ocppb.TestRunArtifact_TestRunStart{TestRunStart: testRunStart},
-	}
-	artiOut = &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestRunArtifact{TestRunArtifact: runArti},
-	}
-	outputArtifact(artiOut)
-
-	testRunEnd = &ocppb.TestRunEnd{
-		Status: ocppb.TestRunEnd_UNKNOWN,
-		Result: ocppb.TestRunEnd_NOT_APPLICABLE,
-	}
+	return dutInfo
 }
 
 // LinkTrain is the top-level function.
@@ -675,6 +804,12 @@ func LinkTrain(cfg *pb.LinkTrain) (pass bool, _ error) {
 		return false, err
 	}
 
+	// The problems finding the links are streamed once the OCP TestRun starts.
+	if ocpRun == nil {
+		OcpInit(nil, fmt.Sprintf("pcie_ltt_%s", strings.TrimPrefix(cfg.GetMethod().String(), "M_")), "undefined",
+			fmt.Sprint(os.Args), cfg)
+	}
+
 	if Lts, err = getLinks(devs, cfg); err != nil {
 		return false, err
 	}
@@ -685,7 +820,9 @@ func LinkTrain(cfg *pb.LinkTrain) (pass bool, _ error) {
 	}
 
 	// Starts OCP TestRun
-	ocpTestRunStart(cfg)
+	if !ocpShared {
+		ocpRun.Start(ocpDutInfo(Lts))
+	}
 
 	// Trains all links in parallel. Waits for all links to finish testing.
 	var wg sync.WaitGroup
@@ -703,23 +840,15 @@ func LinkTrain(cfg *pb.LinkTrain) (pass bool, _ error) {
 	wg.Wait()
 
 	// OCP TestRunEnd
-	testRunEnd.Status = ocppb.TestRunEnd_COMPLETE
-	testRunEnd.Result = ocppb.TestRunEnd_PASS
+	result := ocppb.TestRunEnd_PASS
 	for _, lt := range Lts {
 		if !lt.Pass {
-			testRunEnd.Result = ocppb.TestRunEnd_FAIL
+			result = ocppb.TestRunEnd_FAIL
 		}
 	}
-	runArti := &ocppb.TestRunArtifact{
-		Artifact: &ocppb.TestRunArtifact_TestRunEnd{TestRunEnd: testRunEnd},
-	}
-	artiOut := &ocppb.OutputArtifact{
-		Artifact: &ocppb.OutputArtifact_TestRunArtifact{TestRunArtifact: runArti},
+	if !ocpShared {
+		ocpRun.End(ocppb.TestRunEnd_COMPLETE, result)
 	}
-	outputArtifact(artiOut)
-	ocpPipeLock.Lock()
-	ocpPipe.Close()
-	ocpPipeLock.Unlock()
 
 	for _, lt := range Lts {
 		if !lt.Pass {
@@ -729,18 +858,20 @@ func LinkTrain(cfg *pb.LinkTrain) (pass bool, _ error) {
 	return true, nil
 }
 
-// WriteResultPbtxt writes out the result in a pb.txt.
-func WriteResultPbtxt(outfn string) error {
-	// Marshals test resuLts into pbtxt bytes per link.
+// Result collects the test results of the links.
+func Result() *pb.LinkTrainTests {
 	cfgs := make([]*pb.LinkTrain, len(Lts))
 	for i, lt := range Lts {
 		cfgs[i] = lt.Cfg
 	}
-	ltt := new(pb.LinkTrainTests)
-	ltt.LinkTrain = cfgs
+	return &pb.LinkTrainTests{LinkTrain: cfgs}
+}
 
+// WriteResultPbtxt writes out the result in a pb.txt.
+func WriteResultPbtxt(outfn string) error {
+	// Marshals test resuLts into pbtxt bytes per link.
 	opt := &prototext.MarshalOptions{Multiline: true, Indent: "  "}
-	data, err := opt.Marshal(ltt)
+	data, err := opt.Marshal(Result())
 	if err != nil {
 		return err
 	}
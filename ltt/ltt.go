@@ -26,7 +26,9 @@ import (
 	
 	
 	log "github.com/golang/glog"
+	lmt "local/lanemargintest"
 	lt "local/linktrain"
+	"local/ocpsink"
 	pb "ltt_go.proto"
 )
 
@@ -47,7 +49,8 @@ var (
 	iterations     = flag.Int("iterations", 0, "The number of link training iterations.")
 	parallel       = flag.Bool("parallel", true, "If true, tests multiple links in parallel.")
 	teardownwaitms = flag.Int("teardownwaitms", -1, "Wait in milliseconds after teardown.")
-	ocpPipe        = flag.String("ocp_pipe", "/dev/null", "Named pipe or file to stream the OCP Artifacts.")
+	ocpPipe        = flag.String("ocp_pipe", "/dev/null", "Named pipe or file to stream the OCP Artifacts; or -, unix://, tcp://, http(s):// or rotate:// sinks.")
+	ocpBuf         = flag.Int("ocp_buffer", 0, "Bytes of OCP Artifacts buffered for a slow ocp_pipe consumer before dropping. 0 writes synchronously, blocking on the consumer.")
 )
 
 func main() {
@@ -155,14 +158,17 @@ func main() {
 	})
 
 	// If the file exists, it's assumed to be a named pipe to append in. Otherwise, it's a file to
-	// create and dump into.
-	if f, err := os.OpenFile(*ocpPipe, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777); err != nil {
+	// create and dump into. See ocpsink for the other sinks.
+	if f, err := ocpsink.Open(*ocpPipe, *ocpBuf); err != nil {
 		log.Fatalf("error opening the ocp_pipe: %s %v", *ocpPipe, err)
 	} else {
 		lt.OcpInit(f, fmt.Sprintf("pcie_ltt_%s", strings.TrimPrefix(cfg.GetMethod().String(), "M_")),
-			version, fmt.Sprint(os.Args))
+			version, fmt.Sprint(os.Args), cfg)
 	}
 
+	// The margin checks run the lmt margining.
+	lt.SetMarginChecker(lmt.MarginChecker{})
+
 	// Runs link training test.
 	t := time.Now()
 	log.V(0).Infoln("Starting LinkTrain: t = ", t.String())
@@ -0,0 +1,97 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// ocpcheck validates the OCP artifact streams (JSONL) written by lmt and ltt to the -ocp_pipe.
+// It exits with 1 if any stream has a violation, such as a lost artifact or a truncated stream.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"flag"
+
+	log "github.com/golang/glog"
+	sc "local/streamcheck"
+)
+
+var (
+	version   = "2024-05-17"
+	buildTime = "unknown"
+
+	getVer  = flag.Bool("version", false, "Return the version number.")
+	maxViol = flag.Int("max_violations", 50, "The max number of violations to print per stream. 0 prints all.")
+)
+
+// checkStream checks a stream and prints its report. Returns false if it has any violation.
+func checkStream(name string, r io.Reader) bool {
+	rpt, err := sc.Check(r)
+	if err != nil {
+		log.Errorf("%s: %v", name, err)
+		return false
+	}
+	for i, v := range rpt.Violations {
+		if *maxViol > 0 && i == *maxViol {
+			fmt.Printf("%s: ... %d more violations\n", name, len(rpt.Violations)-i)
+			break
+		}
+		fmt.Printf("%s: %s\n", name, v)
+	}
+	status := "OK"
+	if !rpt.OK() {
+		status = "FAIL"
+	}
+	fmt.Printf("%s: %s: %d artifacts, sequence %d..%d (%d out of order), %d steps, %d series, %d violations\n",
+		name, status, rpt.Artifacts, rpt.FirstSeq, rpt.LastSeq, rpt.OutOfOrder, rpt.Steps, rpt.Series,
+		len(rpt.Violations))
+	return rpt.OK()
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] ocp.jsonl... (- for stdin)\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *getVer {
+		fmt.Printf("Version:\t%s\n", version)
+		fmt.Printf("BuildTime:\t%s\n", buildTime)
+		os.Exit(0)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ok := true
+	for _, fn := range flag.Args() {
+		if fn == "-" {
+			ok = checkStream("stdin", os.Stdin) && ok
+			continue
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			log.Error(err)
+			ok = false
+			continue
+		}
+		ok = checkStream(fn, f) && ok
+		f.Close()
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package streamcheck validates an OCP artifact stream, one JSON OutputArtifact per line, as
+// written to the -ocp_pipe by lmt and ltt.
+//
+// The sequence numbers are stamped and written under one lock of the ocpout.Run, so even the
+// artifacts of parallel links are in order. The sequence is checked for gaps, duplicates and
+// order. The order of the artifacts within a test step or a measurement series is checked too.
+package streamcheck
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"local/ocpout"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// A Violation is a stream error found at a line.
+type Violation struct {
+	Line    int // 1-based line number in the stream; 0 if found at the end of the stream.
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Line == 0 {
+		return "EOF: " + v.Message
+	}
+	return fmt.Sprintf("line %d: %s", v.Line, v.Message)
+}
+
+// Report is the result of checking a stream.
+type Report struct {
+	Artifacts  int   // The number of artifacts parsed.
+	FirstSeq   int32 // The smallest sequence number seen.
+	LastSeq    int32 // The largest sequence number seen.
+	OutOfOrder int   // The number of artifacts written after a larger sequence number.
+	Steps      int   // The number of test steps started.
+	Series     int   // The number of measurement series started.
+	Violations []Violation
+}
+
+// OK reports whether the stream has no violations.
+func (r *Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// stepState tracks a test step by its test_step_id.
+type stepState struct {
+	startLine int
+	ended     bool
+}
+
+// seriesKey identifies a measurement series. ltt reuses the measurement_series_id of a checker
+// across the links tested in parallel, so the series are told apart by their test step as well.
+type seriesKey struct {
+	step, series string
+}
+
+// seriesState tracks a measurement series.
+type seriesState struct {
+	startLine int
+	elements  int32
+	ended     bool
+}
+
+// checker holds the state of a stream being checked.
+type checker struct {
+	r        *Report
+	line     int
+	seqs     map[int32]int // sequence number to the first line seen
+	maxSeq   int32
+	schema   int // line of the SchemaVersion, 0 if not seen
+	runStart int // line of the TestRunStart, 0 if not seen
+	runEnd   int // line of the TestRunEnd, 0 if not seen
+	steps    map[string]*stepState
+	series   map[seriesKey]*seriesState
+}
+
+// violate records a violation at the current line.
+func (c *checker) violate(format string, a ...any) {
+	c.r.Violations = append(c.r.Violations, Violation{c.line, fmt.Sprintf(format, a...)})
+}
+
+// Check reads the whole stream and reports its violations. An error is returned only if the
+// stream can't be read.
+func Check(rd io.Reader) (*Report, error) {
+	c := &checker{
+		r:      new(Report),
+		seqs:   make(map[int32]int),
+		steps:  make(map[string]*stepState),
+		series: make(map[seriesKey]*seriesState),
+	}
+	br := bufio.NewReader(rd)
+	opt := protojson.UnmarshalOptions{DiscardUnknown: true}
+	for {
+		data, err := br.ReadBytes('\n')
+		if len(data) > 0 {
+			c.line++
+			complete := data[len(data)-1] == '\n'
+			if len(data) == 1 && complete {
+				c.violate("empty line")
+			} else {
+				arti := new(ocppb.OutputArtifact)
+				if err := opt.Unmarshal(data, arti); err != nil {
+					if !complete {
+						c.violate("truncated artifact at the end of the stream: %v", err)
+					} else {
+						c.violate("malformed artifact: %v", err)
+					}
+				} else {
+					c.artifact(arti)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return c.r, err
+		}
+	}
+	c.finish()
+	return c.r, nil
+}
+
+// artifact checks an artifact in the stream order.
+func (c *checker) artifact(arti *ocppb.OutputArtifact) {
+	c.r.Artifacts++
+	seq := arti.GetSequenceNumber()
+	if first, ok := c.seqs[seq]; ok {
+		c.violate("duplicate sequence_number %d; first seen at line %d", seq, first)
+	} else {
+		c.seqs[seq] = c.line
+	}
+	if seq < c.maxSeq {
+		c.r.OutOfOrder++
+		c.violate("sequence_number %d after %d", seq, c.maxSeq)
+	}
+	c.maxSeq = max(c.maxSeq, seq)
+	if c.runEnd != 0 {
+		c.violate("artifact after the TestRunEnd at line %d", c.runEnd)
+	}
+
+	switch a := arti.GetArtifact().(type) {
+	case *ocppb.OutputArtifact_SchemaVersion:
+		if c.schema != 0 {
+			c.violate("duplicate SchemaVersion; first seen at line %d", c.schema)
+			return
+		}
+		c.schema = c.line
+		if c.r.Artifacts != 1 {
+			c.violate("SchemaVersion is not the first artifact")
+		}
+		if v := a.SchemaVersion; v.GetMajor() != ocpout.SchemaMajor {
+			c.violate("unsupported schema version %d.%d; expecting %d.x", v.GetMajor(), v.GetMinor(),
+				ocpout.SchemaMajor)
+		}
+	case *ocppb.OutputArtifact_TestRunArtifact:
+		c.runArtifact(a.TestRunArtifact)
+	case *ocppb.OutputArtifact_TestStepArtifact:
+		if c.runStart == 0 {
+			c.violate("TestStepArtifact before the TestRunStart")
+		}
+		c.stepArtifact(a.TestStepArtifact)
+	default:
+		c.violate("artifact has no content")
+	}
+}
+
+// runArtifact checks a TestRunArtifact.
+func (c *checker) runArtifact(a *ocppb.TestRunArtifact) {
+	switch a.GetArtifact().(type) {
+	case *ocppb.TestRunArtifact_TestRunStart:
+		if c.runStart != 0 {
+			c.violate("duplicate TestRunStart; first seen at line %d", c.runStart)
+			return
+		}
+		c.runStart = c.line
+		if c.schema == 0 {
+			c.violate("TestRunStart before the SchemaVersion")
+		}
+	case *ocppb.TestRunArtifact_TestRunEnd:
+		if c.runStart == 0 {
+			c.violate("TestRunEnd without a TestRunStart")
+		}
+		c.runEnd = c.line
+	}
+}
+
+// stepArtifact checks a TestStepArtifact against the state of its step and series.
+func (c *checker) stepArtifact(a *ocppb.TestStepArtifact) {
+	id := a.GetTestStepId()
+	st := c.steps[id]
+	if start, ok := a.GetArtifact().(*ocppb.TestStepArtifact_TestStepStart); ok {
+		if st != nil && !st.ended {
+			c.violate("TestStepStart %q while the step from line %d is still open", id, st.startLine)
+		}
+		c.steps[id] = &stepState{startLine: c.line}
+		c.r.Steps++
+		if start.TestStepStart.GetName() == "" {
+			c.violate("TestStepStart %q has no name", id)
+		}
+		return
+	}
+	if st == nil {
+		c.violate("%s in step %q without a TestStepStart", stepArtifactName(a), id)
+		st = &stepState{startLine: c.line}
+		c.steps[id] = st
+	} else if st.ended {
+		c.violate("%s in step %q after its TestStepEnd", stepArtifactName(a), id)
+	}
+
+	switch a := a.GetArtifact().(type) {
+	case *ocppb.TestStepArtifact_TestStepEnd:
+		for key, ss := range c.series {
+			if !ss.ended && key.step == id {
+				c.violate("TestStepEnd %q with the measurement series %q still open", id, key.series)
+				ss.ended = true
+			}
+		}
+		st.ended = true
+	case *ocppb.TestStepArtifact_MeasurementSeriesStart:
+		sid := a.MeasurementSeriesStart.GetMeasurementSeriesId()
+		if ss := c.series[seriesKey{id, sid}]; ss != nil {
+			c.violate("duplicate MeasurementSeriesStart %q; first seen at line %d", sid, ss.startLine)
+		}
+		c.series[seriesKey{id, sid}] = &seriesState{startLine: c.line}
+		c.r.Series++
+	case *ocppb.TestStepArtifact_MeasurementSeriesElement:
+		sid := a.MeasurementSeriesElement.GetMeasurementSeriesId()
+		ss := c.series[seriesKey{id, sid}]
+		if ss == nil {
+			c.violate("MeasurementSeriesElement of %q without a MeasurementSeriesStart", sid)
+			return
+		}
+		if ss.ended {
+			c.violate("MeasurementSeriesElement of %q after its MeasurementSeriesEnd", sid)
+		}
+		if idx := a.MeasurementSeriesElement.GetIndex(); idx != ss.elements {
+			c.violate("MeasurementSeriesElement of %q has index %d; expecting %d", sid, idx, ss.elements)
+		}
+		ss.elements++
+	case *ocppb.TestStepArtifact_MeasurementSeriesEnd:
+		sid := a.MeasurementSeriesEnd.GetMeasurementSeriesId()
+		ss := c.series[seriesKey{id, sid}]
+		if ss == nil {
+			c.violate("MeasurementSeriesEnd of %q without a MeasurementSeriesStart", sid)
+			return
+		}
+		if ss.ended {
+			c.violate("duplicate MeasurementSeriesEnd of %q", sid)
+		}
+		if total := a.MeasurementSeriesEnd.GetTotalCount(); total != ss.elements {
+			c.violate("MeasurementSeriesEnd of %q has total_count %d; %d elements seen", sid, total,
+				ss.elements)
+		}
+		ss.ended = true
+	}
+}
+
+// finish checks the state left at the end of the stream.
+func (c *checker) finish() {
+	c.line = 0
+	if c.r.Artifacts == 0 {
+		c.violate("empty stream")
+		return
+	}
+	if c.schema == 0 {
+		c.violate("no SchemaVersion")
+	}
+	if c.runStart == 0 {
+		c.violate("no TestRunStart")
+	}
+	if c.runEnd == 0 {
+		c.violate("no TestRunEnd; the stream may be truncated")
+	}
+	ids := make([]string, 0, len(c.steps))
+	for id := range c.steps {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if st := c.steps[id]; !st.ended {
+			c.violate("TestStepStart %q at line %d has no TestStepEnd", id, st.startLine)
+		}
+	}
+	var open []seriesKey
+	for key, ss := range c.series {
+		if !ss.ended {
+			open = append(open, key)
+		}
+	}
+	slices.SortFunc(open, func(a, b seriesKey) int { return c.series[a].startLine - c.series[b].startLine })
+	for _, key := range open {
+		c.violate("MeasurementSeriesStart %q at line %d has no MeasurementSeriesEnd", key.series,
+			c.series[key].startLine)
+	}
+
+	// The sequence numbers start from 1 and must have no gap.
+	seqs := make([]int32, 0, len(c.seqs))
+	for s := range c.seqs {
+		seqs = append(seqs, s)
+	}
+	slices.Sort(seqs)
+	c.r.FirstSeq = seqs[0]
+	c.r.LastSeq = seqs[len(seqs)-1]
+	if seqs[0] != 1 {
+		c.violate("sequence_number starts from %d; expecting 1", seqs[0])
+	}
+	for i := 1; i < len(seqs); i++ {
+		if gap := seqs[i] - seqs[i-1]; gap > 1 {
+			if gap == 2 {
+				c.violate("sequence_number %d is missing", seqs[i-1]+1)
+			} else {
+				c.violate("sequence_number %d to %d are missing", seqs[i-1]+1, seqs[i]-1)
+			}
+		}
+	}
+}
+
+// stepArtifactName names the kind of a TestStepArtifact for the messages.
+func stepArtifactName(a *ocppb.TestStepArtifact) string {
+	switch a.GetArtifact().(type) {
+	case *ocppb.TestStepArtifact_TestStepEnd:
+		return "TestStepEnd"
+	case *ocppb.TestStepArtifact_Measurement:
+		return "Measurement"
+	case *ocppb.TestStepArtifact_MeasurementSeriesStart:
+		return "MeasurementSeriesStart"
+	case *ocppb.TestStepArtifact_MeasurementSeriesEnd:
+		return "MeasurementSeriesEnd"
+	case *ocppb.TestStepArtifact_MeasurementSeriesElement:
+		return "MeasurementSeriesElement"
+	case *ocppb.TestStepArtifact_Diagnosis:
+		return "Diagnosis"
+	case *ocppb.TestStepArtifact_Error:
+		return "Error"
+	case *ocppb.TestStepArtifact_File:
+		return "File"
+	case *ocppb.TestStepArtifact_Log:
+		return "Log"
+	case *ocppb.TestStepArtifact_Extension:
+		return "Extension"
+	}
+	return "empty artifact"
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streamcheck
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	"local/ocpout"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// validStream returns the lines of a complete stream, numbered 1 to 10:
+// SchemaVersion, TestRunStart, TestStepStart, Log, MeasurementSeriesStart, 2 elements,
+// MeasurementSeriesEnd, TestStepEnd and TestRunEnd.
+func validStream() []string {
+	var b bytes.Buffer
+	r := ocpout.NewRun(&b, "pcie_lmt", "v1", "lmt")
+	r.Start(&ocppb.DutInfo{})
+	step := r.StartStep("BDF=0000:81:00.0;RX=DSP_A1", "LMT@BDF=0000:81:00.0;RX=DSP_A1")
+	ocpout.Infof(step, "", "margining")
+	se := step.StartSeries(&ocppb.MeasurementSeriesStart{MeasurementSeriesId: "width", Name: "width"})
+	se.Add(structpb.NewNumberValue(0.5))
+	se.Add(structpb.NewNumberValue(0.4))
+	se.End()
+	step.End(ocppb.TestRunEnd_COMPLETE)
+	r.End(ocppb.TestRunEnd_COMPLETE, ocppb.TestRunEnd_PASS)
+	return strings.SplitAfter(strings.TrimSuffix(b.String(), "\n"), "\n")
+}
+
+func TestCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(lines []string) []string
+		want []string // a substring of each violation, in order
+	}{{
+		name: "valid",
+		edit: func(lines []string) []string { return lines },
+	}, {
+		name: "gap",
+		edit: func(lines []string) []string { return append(lines[:3:3], lines[4:]...) },
+		want: []string{"sequence_number 4 is missing"},
+	}, {
+		name: "duplicate",
+		edit: func(lines []string) []string { return append(lines[:4:4], lines[3:]...) },
+		want: []string{"duplicate sequence_number 4; first seen at line 4"},
+	}, {
+		name: "out of order",
+		edit: func(lines []string) []string {
+			lines[3], lines[4] = lines[4], lines[3]
+			return lines
+		},
+		want: []string{"sequence_number 4 after 5"},
+	}, {
+		name: "truncated tail",
+		edit: func(lines []string) []string {
+			last := lines[len(lines)-1]
+			return append(lines[:len(lines)-1], last[:len(last)/2])
+		},
+		want: []string{"truncated artifact at the end of the stream", "no TestRunEnd"},
+	}, {
+		name: "unclosed step and series",
+		edit: func(lines []string) []string { return append(lines[:7:7], lines[9:]...) },
+		want: []string{
+			`TestStepStart "BDF=0000:81:00.0;RX=DSP_A1" at line 3 has no TestStepEnd`,
+			`MeasurementSeriesStart "width" at line 5 has no MeasurementSeriesEnd`,
+			"sequence_number 8 to 9 are missing",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := strings.Join(tc.edit(validStream()), "")
+			rpt, err := Check(strings.NewReader(stream))
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if len(rpt.Violations) != len(tc.want) {
+				t.Fatalf("got violations %v; want %q", rpt.Violations, tc.want)
+			}
+			for i, v := range rpt.Violations {
+				if !strings.Contains(v.Message, tc.want[i]) {
+					t.Errorf("got violation %v; want %q", v, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocpout
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// A Scope is a Run or a Step, where the tool-side problems are reported.
+type Scope interface {
+	Log(severity ocppb.Log_Severity, message string)
+	Error(symptom string, message string)
+}
+
+// hwMessage prefixes the message with the hardware_info_id it's about, since a Log or an Error
+// has no hardware_info_id of its own.
+func hwMessage(hwInfoID string, format string, args ...any) string {
+	message := fmt.Sprintf(format, args...)
+	if hwInfoID == "" {
+		return message
+	}
+	return hwInfoID + ": " + message
+}
+
+// Logf logs to glog at the severity, and emits a Log about the hardware. It returns the message.
+func Logf(sc Scope, severity ocppb.Log_Severity, hwInfoID string, format string, args ...any) string {
+	return logf(sc, severity, hwInfoID, format, args...)
+}
+
+// Infof logs to glog, and emits an INFO Log about the hardware. It returns the message.
+func Infof(sc Scope, hwInfoID string, format string, args ...any) string {
+	return logf(sc, ocppb.Log_INFO, hwInfoID, format, args...)
+}
+
+// Warningf logs to glog, and emits a WARNING Log about the hardware. It returns the message.
+func Warningf(sc Scope, hwInfoID string, format string, args ...any) string {
+	return logf(sc, ocppb.Log_WARNING, hwInfoID, format, args...)
+}
+
+// logf is called by the exported functions, so glog reports the line of their caller.
+func logf(sc Scope, severity ocppb.Log_Severity, hwInfoID string, format string, args ...any) string {
+	message := hwMessage(hwInfoID, format, args...)
+	switch severity {
+	case ocppb.Log_INFO, ocppb.Log_DEBUG:
+		log.InfoDepth(2, message)
+	case ocppb.Log_WARNING:
+		log.WarningDepth(2, message)
+	default:
+		log.ErrorDepth(2, message)
+	}
+	sc.Log(severity, message)
+	return message
+}
+
+// Errorf logs to glog, and emits an Error of the symptom about the hardware. It returns the
+// message, for the tools appending it to the result.
+func Errorf(sc Scope, hwInfoID string, symptom string, format string, args ...any) string {
+	message := hwMessage(hwInfoID, format, args...)
+	log.ErrorDepth(1, message)
+	sc.Error(symptom, message)
+	return message
+}
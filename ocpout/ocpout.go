@@ -0,0 +1,203 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocpout emits the OCP test artifacts of lmt and ltt as JSON lines.
+//
+// A Run owns the artifact stream: it numbers the artifacts, stamps them, and writes one JSON line
+// per artifact. The TestSteps, MeasurementSeries, Diagnoses, Errors and Logs are built through the
+// Run, a Step or a Series, so both tools compose the artifacts the same way:
+//
+//	run := ocpout.NewRun(w, "pcie_lmt", version, cmdline)
+//	run.SetParameters(cfg)
+//	run.Start(dutInfo)
+//	step := run.StartStep(id, name)
+//	step.Measurement(m)
+//	step.End(ocppb.TestRunEnd_COMPLETE)
+//	run.End(ocppb.TestRunEnd_COMPLETE, ocppb.TestRunEnd_PASS)
+//
+// The writer and the clock are the only outside inputs, so the emission can be checked against a
+// bytes.Buffer with a fixed clock.
+package ocpout
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+const (
+	// SchemaMajor is the major version of the OCP output schema.
+	SchemaMajor = 2
+	// SchemaMinor is the minor version of the OCP output schema.
+	SchemaMinor = 0
+)
+
+// PortHwInfoID is the OCP hardware_info_id of a PCIe port.
+func PortHwInfoID(bdf string) string {
+	return "BDF=" + bdf
+}
+
+// ReceiverHwInfoID is the OCP hardware_info_id of a receiver accessed through the port, e.g.
+// "BDF=0000:81:00.0;RX=DSP_A1".
+func ReceiverHwInfoID(bdf string, receiver string) string {
+	return PortHwInfoID(bdf) + ";RX=" + receiver
+}
+
+// A Run streams the artifacts of one OCP TestRun.
+type Run struct {
+	w     io.Writer
+	start *ocppb.TestRunStart
+	now   func() time.Time
+
+	mu  sync.Mutex // Serializes the numbering and the writing, so the stream is in order.
+	seq int32
+
+	heldMu  sync.Mutex
+	started bool
+	held    []*ocppb.TestRunArtifact // The Logs and Errors before the TestRunStart.
+}
+
+// NewRun starts composing a TestRun streamed to w. A nil w discards the artifacts.
+func NewRun(w io.Writer, name string, version string, cmdline string) *Run {
+	if w == nil {
+		w = io.Discard
+	}
+	return &Run{
+		w: w,
+		start: &ocppb.TestRunStart{
+			Name:        name,
+			Version:     version,
+			CommandLine: cmdline,
+		},
+		now: time.Now,
+	}
+}
+
+// SetClock replaces the clock stamping the artifacts.
+func (r *Run) SetClock(now func() time.Time) {
+	r.now = now
+}
+
+// SetParameters sets the TestRunStart parameters to the test spec, with the proto field names.
+func (r *Run) SetParameters(spec proto.Message) error {
+	opt := protojson.MarshalOptions{UseProtoNames: true}
+	data, err := opt.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	var v structpb.Struct
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	r.start.Parameters = &v
+	return nil
+}
+
+// Emit numbers, stamps and writes an artifact as one JSON line, so a sink never splits an
+// artifact.
+func (r *Run) Emit(artiOut *ocppb.OutputArtifact) {
+	opt := protojson.MarshalOptions{}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The number is only taken by an artifact marshaled, so a failure doesn't leave a gap.
+	artiOut.SequenceNumber = r.seq + 1
+	artiOut.Timestamp = timestamppb.New(r.now())
+	data, err := opt.Marshal(artiOut)
+	if err != nil {
+		log.Errorf("protojson.Marshal(%v) failed: %v", artiOut, err)
+		return
+	}
+	r.seq++
+	if _, err := r.w.Write(append(data, '\n')); err != nil {
+		log.Errorf("Writing the OCP artifact %d failed: %v", r.seq, err)
+	}
+}
+
+// emitRun emits a TestRunArtifact.
+func (r *Run) emitRun(runArti *ocppb.TestRunArtifact) {
+	r.Emit(&ocppb.OutputArtifact{
+		Artifact: &ocppb.OutputArtifact_TestRunArtifact{TestRunArtifact: runArti},
+	})
+}
+
+// Start emits the SchemaVersion and the TestRunStart of the DUT.
+func (r *Run) Start(dutInfo *ocppb.DutInfo) {
+	r.Emit(&ocppb.OutputArtifact{
+		Artifact: &ocppb.OutputArtifact_SchemaVersion{
+			SchemaVersion: &ocppb.SchemaVersion{Major: SchemaMajor, Minor: SchemaMinor},
+		},
+	})
+	r.start.DutInfo = dutInfo
+	r.emitRun(&ocppb.TestRunArtifact{
+		Artifact: &ocppb.TestRunArtifact_TestRunStart{TestRunStart: r.start},
+	})
+
+	r.heldMu.Lock()
+	held := r.held
+	r.started, r.held = true, nil
+	r.heldMu.Unlock()
+	for _, runArti := range held {
+		r.emitRun(runArti)
+	}
+}
+
+// emitOrHold emits a run level Log or Error, or holds it until the TestRunStart, which must come
+// first in the stream.
+func (r *Run) emitOrHold(runArti *ocppb.TestRunArtifact) {
+	r.heldMu.Lock()
+	if !r.started {
+		r.held = append(r.held, runArti)
+		r.heldMu.Unlock()
+		return
+	}
+	r.heldMu.Unlock()
+	r.emitRun(runArti)
+}
+
+// End emits the TestRunEnd, and closes the writer if it's a closer.
+func (r *Run) End(status ocppb.TestRunEnd_TestStatus, result ocppb.TestRunEnd_TestResult) error {
+	r.emitRun(&ocppb.TestRunArtifact{
+		Artifact: &ocppb.TestRunArtifact_TestRunEnd{
+			TestRunEnd: &ocppb.TestRunEnd{Status: status, Result: result},
+		},
+	})
+	if c, ok := r.w.(io.Closer); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return c.Close()
+	}
+	return nil
+}
+
+// Log emits a run level Log. Before Start, it's held until the TestRunStart.
+func (r *Run) Log(severity ocppb.Log_Severity, message string) {
+	r.emitOrHold(&ocppb.TestRunArtifact{
+		Artifact: &ocppb.TestRunArtifact_Log{Log: &ocppb.Log{Severity: severity, Message: message}},
+	})
+}
+
+// Error emits a run level Error. Before Start, it's held until the TestRunStart.
+func (r *Run) Error(symptom string, message string) {
+	r.emitOrHold(&ocppb.TestRunArtifact{
+		Artifact: &ocppb.TestRunArtifact_Error{Error: &ocppb.Error{Symptom: symptom, Message: message}},
+	})
+}
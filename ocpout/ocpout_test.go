@@ -0,0 +1,175 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocpout
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+var fixedTime = time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+
+// newTestRun starts composing a run to a buffer with a fixed clock.
+func newTestRun() (*Run, *bytes.Buffer) {
+	var b bytes.Buffer
+	r := NewRun(&b, "pcie_lmt", "v1", "lmt -spec=x")
+	r.SetClock(func() time.Time { return fixedTime })
+	return r, &b
+}
+
+// parse splits the stream into its artifacts, one per JSON line.
+func parse(t *testing.T, b *bytes.Buffer) []*ocppb.OutputArtifact {
+	t.Helper()
+	var artis []*ocppb.OutputArtifact
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		arti := new(ocppb.OutputArtifact)
+		if err := protojson.Unmarshal([]byte(line), arti); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", line, err)
+		}
+		artis = append(artis, arti)
+	}
+	return artis
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	r, b := newTestRun()
+	r.Start(&ocppb.DutInfo{DutInfoId: "dut"})
+	step := r.StartStep("BDF=0000:81:00.0;RX=DSP_A1", "DSP_A1")
+	step.Measurement(&ocppb.Measurement{Name: "eye_width"})
+	step.End(ocppb.TestRunEnd_COMPLETE)
+	if err := r.End(ocppb.TestRunEnd_COMPLETE, ocppb.TestRunEnd_PASS); err != nil {
+		t.Fatal(err)
+	}
+
+	artis := parse(t, b)
+	if len(artis) != 6 {
+		t.Fatalf("got %d artifacts; want 6", len(artis))
+	}
+	for i, arti := range artis {
+		if got := arti.GetSequenceNumber(); got != int32(i+1) {
+			t.Errorf("artifact %d has sequence number %d; want %d", i, got, i+1)
+		}
+		if got := arti.GetTimestamp().AsTime(); !got.Equal(fixedTime) {
+			t.Errorf("artifact %d is stamped %v; want %v", i, got, fixedTime)
+		}
+	}
+	if artis[0].GetSchemaVersion().GetMajor() != SchemaMajor {
+		t.Errorf("got %v first; want the SchemaVersion", artis[0])
+	}
+	if start := artis[1].GetTestRunArtifact().GetTestRunStart(); start.GetName() != "pcie_lmt" ||
+		start.GetDutInfo().GetDutInfoId() != "dut" {
+		t.Errorf("got %v second; want the TestRunStart of the dut", artis[1])
+	}
+	if got := artis[3].GetTestStepArtifact().GetTestStepId(); got != step.ID() {
+		t.Errorf("the measurement has test_step_id %q; want %q", got, step.ID())
+	}
+	if artis[5].GetTestRunArtifact().GetTestRunEnd().GetResult() != ocppb.TestRunEnd_PASS {
+		t.Errorf("got %v last; want the passing TestRunEnd", artis[5])
+	}
+}
+
+func TestLogsHeldBeforeStart(t *testing.T) {
+	r, b := newTestRun()
+	Warningf(r, PortHwInfoID("0000:81:00.0"), "Speed %d is not gen4 nor gen5.", 3)
+	Errorf(r, "", "pcie_lmt-pcie-cap-missing", "no PCIe capability")
+	if b.Len() != 0 {
+		t.Fatalf("got %q before Start; want nothing", b.String())
+	}
+	r.Start(&ocppb.DutInfo{})
+	Infof(r, "", "after the start")
+
+	artis := parse(t, b)
+	if len(artis) != 5 {
+		t.Fatalf("got %d artifacts; want 5", len(artis))
+	}
+	if artis[1].GetTestRunArtifact().GetTestRunStart() == nil {
+		t.Fatalf("got %v second; want the TestRunStart before the held artifacts", artis[1])
+	}
+	warning := artis[2].GetTestRunArtifact().GetLog()
+	if warning.GetSeverity() != ocppb.Log_WARNING ||
+		warning.GetMessage() != "BDF=0000:81:00.0: Speed 3 is not gen4 nor gen5." {
+		t.Errorf("got %v third; want the held warning", artis[2])
+	}
+	if err := artis[3].GetTestRunArtifact().GetError(); err.GetSymptom() != "pcie_lmt-pcie-cap-missing" {
+		t.Errorf("got %v fourth; want the held error", artis[3])
+	}
+	if info := artis[4].GetTestRunArtifact().GetLog(); info.GetMessage() != "after the start" {
+		t.Errorf("got %v last; want the log after the start", artis[4])
+	}
+}
+
+func TestSeries(t *testing.T) {
+	r, b := newTestRun()
+	r.Start(&ocppb.DutInfo{})
+	step := r.StartStep("step", "step")
+	se := step.StartSeries(&ocppb.MeasurementSeriesStart{MeasurementSeriesId: "width", Name: "width"})
+	for i := 0; i < 2; i++ {
+		se.Add(structpb.NewNumberValue(float64(16 - i)))
+	}
+	iteration, _ := structpb.NewStruct(map[string]any{"iteration": 7})
+	se.AddWithMetadata(structpb.NewNumberValue(14), iteration)
+	if se.Count() != 3 {
+		t.Errorf("got Count %d; want 3", se.Count())
+	}
+	se.End()
+
+	var elements []*ocppb.MeasurementSeriesElement
+	var end *ocppb.MeasurementSeriesEnd
+	for _, arti := range parse(t, b) {
+		stepArti := arti.GetTestStepArtifact()
+		if e := stepArti.GetMeasurementSeriesElement(); e != nil {
+			elements = append(elements, e)
+		}
+		if e := stepArti.GetMeasurementSeriesEnd(); e != nil {
+			end = e
+		}
+	}
+	if len(elements) != 3 {
+		t.Fatalf("got %d elements; want 3", len(elements))
+	}
+	for i, e := range elements {
+		if e.GetIndex() != int32(i) || e.GetMeasurementSeriesId() != "width" || e.GetValue().GetNumberValue() != float64(16-i) {
+			t.Errorf("element %d is %v; want index %d of width valued %d", i, e, i, 16-i)
+		}
+	}
+	if got := elements[2].GetMetadata().GetFields()["iteration"].GetNumberValue(); got != 7 {
+		t.Errorf("got the last element metadata %v; want iteration 7", elements[2].GetMetadata())
+	}
+	if end.GetMeasurementSeriesId() != "width" || end.GetTotalCount() != 3 {
+		t.Errorf("got the series end %v; want width with total count 3", end)
+	}
+}
+
+func TestMarshalFailureLeavesNoGap(t *testing.T) {
+	r, b := newTestRun()
+	r.Start(&ocppb.DutInfo{})
+	// protojson rejects a string of invalid UTF-8.
+	Infof(r, "", "bad \xff")
+	Infof(r, "", "good")
+
+	artis := parse(t, b)
+	if len(artis) != 3 {
+		t.Fatalf("got %d artifacts; want 3, without the one failing to marshal", len(artis))
+	}
+	if got := artis[2].GetSequenceNumber(); got != 3 {
+		t.Errorf("got sequence number %d after the failure; want 3", got)
+	}
+}
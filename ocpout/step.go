@@ -0,0 +1,147 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocpout
+
+import (
+	"sync"
+
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	ocppb "ocpdiag/results_go_proto"
+)
+
+// A Step emits the artifacts of one OCP TestStep. The lanes of a receiver share its Step, so
+// the Step is safe for concurrent use.
+type Step struct {
+	run *Run
+	id  string
+}
+
+// StartStep emits a TestStepStart.
+func (r *Run) StartStep(id string, name string) *Step {
+	s := &Step{run: r, id: id}
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_TestStepStart{TestStepStart: &ocppb.TestStepStart{Name: name}},
+	})
+	return s
+}
+
+// ID is the test_step_id.
+func (s *Step) ID() string {
+	return s.id
+}
+
+// emit emits a TestStepArtifact of the step.
+func (s *Step) emit(stepArti *ocppb.TestStepArtifact) {
+	stepArti.TestStepId = s.id
+	s.run.Emit(&ocppb.OutputArtifact{
+		Artifact: &ocppb.OutputArtifact_TestStepArtifact{TestStepArtifact: stepArti},
+	})
+}
+
+// End emits the TestStepEnd.
+func (s *Step) End(status ocppb.TestRunEnd_TestStatus) {
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_TestStepEnd{TestStepEnd: &ocppb.TestStepEnd{Status: status}},
+	})
+}
+
+// Measurement emits a Measurement. m is marshaled before returning, so it may be reused.
+func (s *Step) Measurement(m *ocppb.Measurement) {
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_Measurement{Measurement: m},
+	})
+}
+
+// Diagnosis emits a Diagnosis.
+func (s *Step) Diagnosis(diag *ocppb.Diagnosis) {
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_Diagnosis{Diagnosis: diag},
+	})
+}
+
+// Log emits a step level Log.
+func (s *Step) Log(severity ocppb.Log_Severity, message string) {
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_Log{Log: &ocppb.Log{Severity: severity, Message: message}},
+	})
+}
+
+// Error emits a step level Error.
+func (s *Step) Error(symptom string, message string) {
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_Error{Error: &ocppb.Error{Symptom: symptom, Message: message}},
+	})
+}
+
+// A Series emits the elements of one MeasurementSeries, indexed in order.
+type Series struct {
+	step *Step
+	id   string
+
+	mu    sync.Mutex
+	count int32
+}
+
+// StartSeries emits a MeasurementSeriesStart.
+func (s *Step) StartSeries(start *ocppb.MeasurementSeriesStart) *Series {
+	s.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_MeasurementSeriesStart{MeasurementSeriesStart: start},
+	})
+	return &Series{step: s, id: start.GetMeasurementSeriesId()}
+}
+
+// Add emits the next MeasurementSeriesElement.
+func (se *Series) Add(value *structpb.Value) {
+	se.AddWithMetadata(value, nil)
+}
+
+// AddWithMetadata emits the next MeasurementSeriesElement with its metadata, e.g. the iteration
+// it was measured at, when the index alone doesn't tell.
+func (se *Series) AddWithMetadata(value *structpb.Value, metadata *structpb.Struct) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.step.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_MeasurementSeriesElement{
+			MeasurementSeriesElement: &ocppb.MeasurementSeriesElement{
+				Index:               se.count,
+				MeasurementSeriesId: se.id,
+				Value:               value,
+				Timestamp:           timestamppb.New(se.step.run.now()),
+				Metadata:            metadata,
+			},
+		},
+	})
+	se.count++
+}
+
+// Count is the number of elements emitted.
+func (se *Series) Count() int32 {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.count
+}
+
+// End emits the MeasurementSeriesEnd with the total count of elements.
+func (se *Series) End() {
+	se.step.emit(&ocppb.TestStepArtifact{
+		Artifact: &ocppb.TestStepArtifact_MeasurementSeriesEnd{
+			MeasurementSeriesEnd: &ocppb.MeasurementSeriesEnd{
+				MeasurementSeriesId: se.id,
+				TotalCount:          se.Count(),
+			},
+		},
+	})
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocpsink
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// A Buffered queues the writes up to a bound, and writes them to the sink in the background.
+// Write never blocks on the sink: when the queue is full, the write is dropped and counted. The
+// dropped artifacts show up as sequence number gaps in ocpcheck. The TestRunStart and TestRunEnd
+// are queued past the bound, so the stream always opens and closes its run.
+type Buffered struct {
+	w        io.WriteCloser
+	maxBytes int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []byte
+	closed  bool
+	dropped int
+	err     error // the first error of the sink
+	done    chan struct{}
+}
+
+// NewBuffered starts writing to w in the background, queuing up to maxBytes.
+func NewBuffered(w io.WriteCloser, maxBytes int) *Buffered {
+	b := &Buffered{w: w, maxBytes: maxBytes, done: make(chan struct{})}
+	b.cond = sync.NewCond(&b.mu)
+	go b.drain()
+	return b
+}
+
+// Write queues a copy of p. It returns an error only after Close.
+func (b *Buffered) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.queue)+len(p) > b.maxBytes && !isRunStartEnd(p) {
+		if b.dropped == 0 {
+			log.Warningf("The OCP sink is too slow; dropping artifacts beyond %d queued bytes.", b.maxBytes)
+		}
+		b.dropped++
+		return len(p), nil
+	}
+	b.queue = append(b.queue, p...)
+	b.cond.Signal()
+	return len(p), nil
+}
+
+// isRunStartEnd tells whether the JSON line is a TestRunStart or TestRunEnd artifact. A quote in a
+// string value is escaped, so only the keys match.
+func isRunStartEnd(p []byte) bool {
+	return bytes.Contains(p, []byte(`"testRunStart"`)) || bytes.Contains(p, []byte(`"testRunEnd"`))
+}
+
+// drain writes the queued bytes to the sink, coalescing what's queued meanwhile into one write.
+func (b *Buffered) drain() {
+	defer close(b.done)
+	var out []byte
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.queue) == 0 && b.closed {
+			b.mu.Unlock()
+			return
+		}
+		out, b.queue = b.queue, out[:0]
+		b.mu.Unlock()
+
+		if b.err == nil {
+			if _, err := b.w.Write(out); err != nil {
+				log.Errorf("Writing to the OCP sink failed; dropping the rest of the stream: %v", err)
+				b.err = err
+			}
+		}
+	}
+}
+
+// Close writes out the queue, and closes the sink.
+func (b *Buffered) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Signal()
+	b.mu.Unlock()
+	<-b.done
+	if b.dropped > 0 {
+		log.Warningf("%d OCP artifact writes were dropped by the slow sink.", b.dropped)
+	}
+	err := b.w.Close()
+	if b.err != nil {
+		return b.err
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocpsink opens the destination of an OCP artifact stream from the -ocp_pipe flag.
+//
+// The sinks are selected by the scheme of the flag value:
+//
+//   - stdout
+//     unix:///run/ocp.sock       a Unix domain stream socket
+//     tcp://host:port            a TCP stream
+//     http://host:port/path      an HTTP POST of the JSON lines per write; also https://
+//     rotate:///var/log/ocp.json a file rotated by size, e.g. ?max_bytes=10485760&backups=5
+//     /path/to/file_or_fifo      a file to create, or an existing named pipe to append to
+//
+// Every write is whole JSON lines, so a rotated file or a POST never splits an artifact.
+package ocpsink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpTimeout bounds a POST to the HTTP endpoint.
+const httpTimeout = 10 * time.Second
+
+// Open opens the sink of the -ocp_pipe flag value. If bufBytes > 0, the sink is wrapped in a
+// bounded buffer written in the background, so a slow consumer doesn't stall the test, at the
+// cost of dropping artifacts. Otherwise, a write blocks until the consumer takes it.
+func Open(dest string, bufBytes int) (io.WriteCloser, error) {
+	w, err := open(dest)
+	if err != nil {
+		return nil, err
+	}
+	if bufBytes > 0 {
+		return NewBuffered(w, bufBytes), nil
+	}
+	return w, nil
+}
+
+// open opens the sink without buffering.
+func open(dest string) (io.WriteCloser, error) {
+	if dest == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	scheme, rest, ok := strings.Cut(dest, "://")
+	if !ok {
+		// If the file exists, it's assumed to be a named pipe to append in. Otherwise, it's a file
+		// to create and dump into.
+		return os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	}
+	switch scheme {
+	case "unix", "tcp":
+		return net.Dial(scheme, rest)
+	case "http", "https":
+		return &httpSink{url: dest, client: &http.Client{Timeout: httpTimeout}}, nil
+	case "rotate":
+		u, err := url.Parse(dest)
+		if err != nil {
+			return nil, err
+		}
+		maxBytes, backups := int64(defaultMaxBytes), defaultBackups
+		if v := u.Query().Get("max_bytes"); v != "" {
+			if maxBytes, err = strconv.ParseInt(v, 0, 64); err != nil || maxBytes <= 0 {
+				return nil, fmt.Errorf("bad max_bytes in %s", dest)
+			}
+		}
+		if v := u.Query().Get("backups"); v != "" {
+			if backups, err = strconv.Atoi(v); err != nil || backups < 0 {
+				return nil, fmt.Errorf("bad backups in %s", dest)
+			}
+		}
+		// rotate://ocp.json is relative to the working directory.
+		return NewRotating(u.Host+u.Path, maxBytes, backups)
+	}
+	return nil, fmt.Errorf("unknown ocp_pipe scheme %q in %s", scheme, dest)
+}
+
+// nopCloser keeps stdout open after the stream ends.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// httpSink POSTs every write to an HTTP endpoint as newline delimited JSON.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Write(p []byte) (int, error) {
+	rsp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("POST %s: %s", s.url, rsp.Status)
+	}
+	return len(p), nil
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
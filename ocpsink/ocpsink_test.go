@@ -0,0 +1,241 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocpsink
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	runStart = `{"testRunArtifact":{"testRunStart":{"name":"pcie_lmt"}},"sequenceNumber":1}` + "\n"
+	runLog   = `{"testRunArtifact":{"log":{"message":"\"testRunEnd\" is quoted"}},"sequenceNumber":2}` + "\n"
+	runEnd   = `{"testRunArtifact":{"testRunEnd":{"status":"COMPLETE"}},"sequenceNumber":3}` + "\n"
+)
+
+// writeStream writes the lines to the sink of dest, and closes it.
+func writeStream(t *testing.T, dest string, bufBytes int, lines ...string) {
+	t.Helper()
+	w, err := Open(dest, bufBytes)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", dest, err)
+	}
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l); err != nil {
+			t.Fatalf("Write to %q: %v", dest, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close %q: %v", dest, err)
+	}
+}
+
+// listen accepts one stream connection on l, and returns what it reads until the close.
+func listen(t *testing.T, l net.Listener) <-chan string {
+	got := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			got <- ""
+			return
+		}
+		defer c.Close()
+		data, _ := io.ReadAll(c)
+		got <- string(data)
+	}()
+	return got
+}
+
+func TestOpenTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := listen(t, l)
+	writeStream(t, "tcp://"+l.Addr().String(), 0, runStart, runLog, runEnd)
+	if want := runStart + runLog + runEnd; <-got != want {
+		t.Errorf("tcp:// sink got a different stream; want %q", want)
+	}
+}
+
+func TestOpenUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ocp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := listen(t, l)
+	writeStream(t, "unix://"+sock, 1<<10, runStart, runLog, runEnd)
+	if want := runStart + runLog + runEnd; <-got != want {
+		t.Errorf("unix:// sink got a different stream; want %q", want)
+	}
+}
+
+func TestOpenHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("got %s %s; want a POST of application/x-ndjson", r.Method, r.Header.Get("Content-Type"))
+		}
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		posts = append(posts, string(data))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	writeStream(t, srv.URL+"/ocp", 0, runStart, runEnd)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posts) != 2 || posts[0] != runStart || posts[1] != runEnd {
+		t.Errorf("got POSTs %q; want one per write", posts)
+	}
+}
+
+func TestOpenHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	w, err := Open(srv.URL, 0)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", srv.URL, err)
+	}
+	defer w.Close()
+	if _, err := io.WriteString(w, runStart); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Write got error %v; want the 503 status", err)
+	}
+}
+
+func TestOpenUnknownScheme(t *testing.T) {
+	if _, err := Open("ftp://localhost/ocp", 0); err == nil {
+		t.Error("Open(ftp://) got no error; want an unknown scheme error")
+	}
+}
+
+func TestOpenRotate(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ocp.json")
+	// A file holds the run start and end, but not two logs.
+	maxBytes := len(runStart) + len(runEnd)
+	dest := fmt.Sprintf("rotate://%s?max_bytes=%d&backups=2", fn, maxBytes)
+	writeStream(t, dest, 0, runStart, runEnd, runLog, runLog, runEnd, runStart)
+
+	// The first file, holding the run start and end, is rotated out beyond the 2 backups.
+	for _, tc := range []struct {
+		fn   string
+		want string
+	}{
+		{fn, runEnd + runStart},
+		{fn + ".1", runLog},
+		{fn + ".2", runLog},
+	} {
+		data, err := os.ReadFile(tc.fn)
+		if err != nil {
+			t.Errorf("ReadFile: %v", err)
+			continue
+		}
+		if string(data) != tc.want {
+			t.Errorf("%s got %q; want %q", filepath.Base(tc.fn), data, tc.want)
+		}
+	}
+	if _, err := os.Stat(fn + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Stat(%s.3) got error %v; want no such file beyond the backups", fn, err)
+	}
+}
+
+func TestOpenRotateQuery(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ocp.json")
+	for _, tc := range []struct {
+		query        string
+		wantMaxBytes int64
+		wantBackups  int
+		wantErr      bool
+	}{
+		{query: "", wantMaxBytes: defaultMaxBytes, wantBackups: defaultBackups},
+		{query: "?max_bytes=0x1000&backups=0", wantMaxBytes: 0x1000, wantBackups: 0},
+		{query: "?max_bytes=0", wantErr: true},
+		{query: "?max_bytes=1M", wantErr: true},
+		{query: "?backups=-1", wantErr: true},
+	} {
+		dest := "rotate://" + fn + tc.query
+		w, err := Open(dest, 0)
+		if tc.wantErr {
+			if err == nil {
+				w.Close()
+				t.Errorf("Open(%q) got no error; want a bad query error", dest)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Open(%q): %v", dest, err)
+			continue
+		}
+		r := w.(*Rotating)
+		if r.fn != fn || r.maxBytes != tc.wantMaxBytes || r.backups != tc.wantBackups {
+			t.Errorf("Open(%q) got %s with max_bytes %d and %d backups; want %s with %d and %d",
+				dest, r.fn, r.maxBytes, r.backups, fn, tc.wantMaxBytes, tc.wantBackups)
+		}
+		r.Close()
+	}
+}
+
+// blockingSink holds every write until released.
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	data    strings.Builder
+}
+
+func (s *blockingSink) Write(p []byte) (int, error) {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Write(p)
+}
+
+func (s *blockingSink) Close() error { return nil }
+
+func TestBufferedKeepsRunStartEnd(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	// The bound is below every line, so only the run start and end are queued.
+	b := NewBuffered(sink, 10)
+	for _, l := range []string{runStart, runLog, runEnd} {
+		if _, err := io.WriteString(b, l); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	close(sink.release)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, want := sink.data.String(), runStart+runEnd; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if b.dropped != 1 {
+		t.Errorf("got %d dropped; want 1", b.dropped)
+	}
+}
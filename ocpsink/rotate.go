@@ -0,0 +1,97 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocpsink
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// defaultMaxBytes is the size of a rotated file.
+	defaultMaxBytes = 64 << 20
+	// defaultBackups is the number of rotated files kept besides the current one.
+	defaultBackups = 3
+)
+
+// A Rotating is a file sink that rotates the file when it would exceed maxBytes: fn is renamed
+// to fn.1, fn.1 to fn.2, and so on, and the oldest beyond the backups is removed.
+type Rotating struct {
+	fn       string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+}
+
+// NewRotating opens fn to append to, rotated by size.
+func NewRotating(fn string, maxBytes int64, backups int) (*Rotating, error) {
+	r := &Rotating{fn: fn, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current file, continuing from its size.
+func (r *Rotating) open() error {
+	f, err := os.OpenFile(r.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+// rotate shifts the backups and starts a new current file.
+func (r *Rotating) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.backups == 0 {
+		os.Remove(r.fn)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.fn, r.backups))
+		for i := r.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.fn, i), fmt.Sprintf("%s.%d", r.fn, i+1))
+		}
+		if err := os.Rename(r.fn, r.fn+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// Write writes whole lines. A write larger than maxBytes goes to a file of its own.
+func (r *Rotating) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (r *Rotating) Close() error {
+	return r.f.Close()
+}